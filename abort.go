@@ -0,0 +1,325 @@
+/*
+Copyright 2016 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package workergroup
+
+import "errors"
+import "os"
+import "sync"
+import "time"
+
+// AbortLevel describes how urgently a Worker has been asked to stop, see Abort.Level.
+type AbortLevel int
+
+const (
+	// NoAbort means no abort has been ordered.
+	NoAbort AbortLevel = iota
+
+	// SoftAbort means the Instance is draining (see Instance.Drain): the Worker should stop taking on new work, but
+	// finish what it already has before returning.
+	SoftAbort
+
+	// HardAbort means the Worker should return as soon as possible.
+	HardAbort
+)
+
+// Aborted returns true if the given abort channel has been closed. This never blocks, it is the usual select with a
+// default case, so a Worker can just write:
+//
+//	if workergroup.Aborted(abort) {
+//		return nil
+//	}
+func Aborted(abort <-chan bool) bool {
+	select {
+	case <-abort:
+		return true
+	default:
+		return false
+	}
+}
+
+// ErrAborted is returned by CheckAbort. A Worker that returns it (or an error wrapping it) after the Instance started
+// aborting is treated as having returned nil, so it can be passed straight up from deep inside a Worker.
+var ErrAborted = errors.New("Worker stopped because the Instance is aborting.")
+
+// CheckAbort returns ErrAborted if the given abort channel has been closed, otherwise nil. This is for code that is
+// several calls deep inside a Worker, where returning an error is more natural than returning a flag:
+//
+//	if err := workergroup.CheckAbort(abort); err != nil {
+//		return err
+//	}
+func CheckAbort(abort <-chan bool) error {
+	if Aborted(abort) {
+		return ErrAborted
+	}
+	return nil
+}
+
+// Abort wraps an abort channel with some helper methods, so Workers don't need to write out the select statement
+// every time they want to check it. SignalWorkers are given one of these instead of a raw channel.
+//
+// An Abort is just a thin wrapper, the channel from Chan is the same one a normal Worker gets, so selecting on it works
+// exactly as before.
+type Abort struct {
+	c     <-chan bool
+	drain <-chan bool
+}
+
+// AbortSignal wraps a raw abort channel, as passed to a normal Worker, in an Abort. This allows existing Workers to use
+// the helper methods without changing their signature. An Abort made this way has no drain signal of its own, its
+// DrainChan is closed along with the abort channel.
+func AbortSignal(abort <-chan bool) *Abort {
+	return &Abort{abort, abort}
+}
+
+// Chan returns the underlying abort channel, for use in select statements. It is closed when an abort is ordered.
+func (a *Abort) Chan() <-chan bool {
+	return a.c
+}
+
+// DrainChan returns the Instance's drain channel, see Instance.Draining.
+func (a *Abort) DrainChan() <-chan bool {
+	return a.drain
+}
+
+// IsSet returns true if an abort has been ordered. This never blocks.
+func (a *Abort) IsSet() bool {
+	return Aborted(a.c)
+}
+
+// Level returns the current abort level: HardAbort if an abort has been ordered, SoftAbort if the Instance is only
+// draining, otherwise NoAbort.
+func (a *Abort) Level() AbortLevel {
+	if a.IsSet() {
+		return HardAbort
+	}
+	if Aborted(a.drain) {
+		return SoftAbort
+	}
+	return NoAbort
+}
+
+// SignalWorker is a Worker that gets its abort channel wrapped in an Abort. In every other way it behaves exactly like
+// a normal Worker.
+type SignalWorker func(abort *Abort, data interface{}) error
+
+// AddSignal adds a SignalWorker to the Group, see Add.
+func (wg *Group) AddSignal(count int, worker SignalWorker) {
+	if worker == nil {
+		// Let Validate report it.
+		wg.add(count, nil)
+		return
+	}
+
+	wg.add(count, func(in *Instance, id, copy int, data interface{}) error {
+		return worker(&Abort{in.abort, in.Draining()}, data)
+	})
+}
+
+// Drain asks the Instance's Workers to wind down gracefully: stop taking on new work, finish what they already have,
+// and return nil. Unlike Abort this is only a request, the Instance is not aborted (Wait returns nil if every Worker
+// does) and a Worker error still aborts it as usual. Workers see it through Draining, or Abort.Level for
+// SignalWorkers. Calling Drain more than once, or after an abort, has no effect. Use DrainTimeout to abort Workers
+// that take too long.
+func (in *Instance) Drain() {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+	in.closeDrainLocked()
+}
+
+// ErrDrainTimeout is wrapped by the *DrainTimeoutError returned from Instance.DrainTimeout.
+var ErrDrainTimeout = errors.New("Workers did not finish draining in time and were aborted.")
+
+// DrainTimeoutError is returned by Instance.DrainTimeout when the drain had to be escalated to an abort. errors.Is
+// matches both ErrDrainTimeout and the error the Instance returned.
+type DrainTimeoutError struct {
+	// IDs lists the Workers (their indexes in RunReport.Workers) that had not returned when time ran out, lowest first.
+	IDs []int
+
+	// Err is the error WaitDrain returns, usually NonErrorAbort.
+	Err error
+}
+
+func (err *DrainTimeoutError) Error() string {
+	return workerListError("aborted after the drain timed out", err.IDs, err.Err)
+}
+
+// Unwrap returns ErrDrainTimeout and Err.
+func (err *DrainTimeoutError) Unwrap() []error {
+	return unwrapWith(ErrDrainTimeout, err.Err)
+}
+
+// DrainTimeout is the usual graceful-then-forceful shutdown: it calls Drain, gives the Workers up to d to return, and
+// if any are still running after that it aborts the Instance. Either way it then blocks until the Instance is done.
+//
+// If every Worker returned in time the result is the same as WaitDrain. If the drain had to be escalated it returns a
+// *DrainTimeoutError listing the Workers that were still running. If the Instance was already aborting (a Worker
+// error, say) there is nothing to escalate, and again the result is the same as WaitDrain.
+func (in *Instance) DrainTimeout(d time.Duration) error {
+	in.Drain()
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-in.done:
+		return in.WaitDrain()
+	case <-t.C:
+	}
+
+	in.lock.Lock()
+	var ids []int
+	for id, ch := range in.returned {
+		select {
+		case <-ch:
+		default:
+			ids = append(ids, id)
+		}
+	}
+	escalated := len(ids) > 0 && in.closeAbortLocked(ExplicitAbort, nil)
+	in.lock.Unlock()
+
+	err := in.WaitDrain()
+	if !escalated {
+		return err
+	}
+	return &DrainTimeoutError{IDs: ids, Err: err}
+}
+
+// Draining returns a channel that is closed when Drain is called, or when the Instance aborts (since an aborting
+// Instance should not be taking on new work either). A Worker that should finish its current work on a drain watches
+// this for when to stop pulling new work, and the abort channel for when to give up on the work in progress.
+//
+// Normal Workers don't get the Instance, so they need to capture this channel (or the Instance) some other way. A
+// SignalWorker gets it from Abort.DrainChan.
+//
+// Replace starts a new drain channel for the Workers it adds, so a Worker should get this once, when it starts, and
+// keep using that channel. Calling it again later may return the channel meant for its replacements.
+func (in *Instance) Draining() <-chan bool {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+	return in.drain
+}
+
+// ErrReplaceNodes is returned by Instance.Replace if the new Group has Workers added with AddNode.
+var ErrReplaceNodes = errors.New("Cannot replace Workers with a Group that has AddNode Workers.")
+
+// Replace hands the Instance's work over to the Workers of another Group, for reloading processing logic without
+// stopping. The Workers already running are drained (see Drain), and every Worker of wg is launched in the Instance
+// (see Instance.Add), all in one step: the old Workers finish what they have and return, while the new ones take over.
+// The Instance is done once both sets have returned, and Wait reports on them all as usual. Replace can be called again
+// to replace the replacements.
+//
+// The handoff only works if the old Workers actually stop taking on new work when they see the drain. Any shared work
+// source, such as a jobs channel, must be reachable through the new data value (which is passed to the new Workers in
+// place of the one given to Start) and safe to use from both sets of Workers at once, since for a while they overlap.
+// The new Workers get a drain channel of their own, so they don't see the drain meant for the old ones.
+//
+// Only the Workers are taken from wg. The Instance keeps its own settings, Cleaners, and Finalizers, and those still
+// get the original data value. wg is validated first, any problems are returned without changing anything, and so is
+// ErrReplaceNodes, as AddNode Workers can't depend on Workers in another Group. If every Worker has already returned
+// Replace returns ErrInstanceDone. Replacing the Workers of an Instance that is aborting is allowed, but the new ones
+// will see the abort right away.
+func (in *Instance) Replace(wg *Group, data interface{}) error {
+	if err := wg.Validate(); err != nil {
+		return err
+	}
+	if len(wg.nodes) > 0 {
+		return ErrReplaceNodes
+	}
+
+	in.lock.Lock()
+	if in.sealed {
+		in.lock.Unlock()
+		return ErrInstanceDone
+	}
+
+	in.closeDrainLocked()
+	in.drain = make(chan bool)
+	if Aborted(in.abort) {
+		close(in.drain)
+	}
+
+	var launches []func()
+	for i, w := range wg.workers {
+		w := w
+		launches = append(launches, in.addLocked(wg.counts[i], func(in *Instance, id, copy int, _ interface{}) error {
+			return w(in, id, copy, data)
+		}))
+	}
+	in.lock.Unlock()
+
+	for _, launch := range launches {
+		launch()
+	}
+	return nil
+}
+
+// closeDrainLocked closes the drain channel if it isn't already. The lock must be held.
+func (in *Instance) closeDrainLocked() {
+	select {
+	case <-in.drain:
+	default:
+		close(in.drain)
+	}
+}
+
+// AbortOnFile aborts the Instance as soon as a file exists at the given path, checking once every pollInterval. This
+// is the classic "touch a file to stop the job" kill switch, handy for long running batch jobs where sending a signal
+// or calling an API is awkward.
+//
+// Each poll is a single os.Stat, so the overhead is negligible for any sensible interval, but the abort may happen up
+// to pollInterval after the file appears. If you need an immediate response use a filesystem watcher such as fsnotify
+// and call Abort yourself.
+//
+// The polling goroutine exits when the Instance finishes, when the file is found, or when stop is called. It is safe to
+// call stop more than once, or after the Instance is done. A pollInterval <= 0 turns this off, nothing is watched and
+// stop does nothing.
+func (in *Instance) AbortOnFile(path string, pollInterval time.Duration) (stop func()) {
+	if pollInterval <= 0 {
+		return func() {}
+	}
+
+	halt := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := os.Stat(path); err == nil {
+					in.Abort()
+					return
+				}
+			case <-halt:
+				return
+			case <-in.done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(halt) })
+	}
+}
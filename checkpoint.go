@@ -0,0 +1,105 @@
+/*
+Copyright 2016 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package workergroup
+
+import "context"
+
+// ResumableWorker is a Worker that can save its progress, so that if it is aborted a later run can pick up where it
+// left off. See Group.AddResumable and Group.StartResume.
+type ResumableWorker func(abort <-chan bool, data interface{}, cp *Checkpointer) error
+
+// Checkpointer is given to each ResumableWorker, it saves and loads the checkpoint for that one Worker.
+type Checkpointer struct {
+	in *Instance
+	id int
+}
+
+// Save records state as this Worker's latest checkpoint, replacing any previous one. See Instance.Checkpoint.
+func (cp *Checkpointer) Save(state interface{}) {
+	cp.in.Checkpoint(cp.id, state)
+}
+
+// Last returns this Worker's latest checkpoint. If the Worker hasn't saved one yet in this run, the checkpoint from the
+// run this one is resuming (if any) is returned instead. Returns nil if there is no checkpoint at all.
+func (cp *Checkpointer) Last() interface{} {
+	cp.in.lock.Lock()
+	defer cp.in.lock.Unlock()
+
+	if state, ok := cp.in.checkpoints[cp.id]; ok {
+		return state
+	}
+	return cp.in.resume[cp.id]
+}
+
+// AddResumable adds a ResumableWorker to the Group, see Add.
+func (wg *Group) AddResumable(count int, worker ResumableWorker) {
+	if worker == nil {
+		// Let Validate report it.
+		wg.add(count, nil)
+		return
+	}
+
+	wg.add(count, func(in *Instance, id, copy int, data interface{}) error {
+		return worker(in.abort, data, &Checkpointer{in, id})
+	})
+}
+
+// StartResume is like Start, except the new Instance's Workers are given the checkpoints saved by the Workers in prev.
+// Checkpoints are matched by Worker ID (index in RunReport.Workers), so this only makes sense if the Group has the same
+// Workers it did when prev was started. StartResume waits for prev to finish before starting anything.
+//
+// Checkpoint states are handed over as is, nothing is copied. If you want to keep checkpoints across process
+// restarts, save the map from Instance.Checkpoints yourself (with gob or similar), in which case the states must be
+// types your encoder can handle.
+func (wg *Group) StartResume(prev *Instance, data interface{}) *Instance {
+	var resume map[int]interface{}
+	if prev != nil {
+		prev.WaitDrain()
+		resume = prev.Checkpoints()
+	}
+	return wg.startWith(context.Background(), data, wg.cleaners, resume, 0, 0)
+}
+
+// Checkpoint records state as the latest checkpoint for the Worker with the given ID. Normally ResumableWorkers will
+// use their Checkpointer rather than calling this directly. It is safe to call from many goroutines at once.
+func (in *Instance) Checkpoint(id int, state interface{}) {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+	in.checkpoints[id] = state
+}
+
+// Checkpoints returns the latest checkpoint for every Worker that has one, keyed by Worker ID. Checkpoints carried
+// over from a resumed run are included for Workers that haven't saved a new one.
+func (in *Instance) Checkpoints() map[int]interface{} {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+
+	cps := make(map[int]interface{}, len(in.resume)+len(in.checkpoints))
+	for k, v := range in.resume {
+		cps[k] = v
+	}
+	for k, v := range in.checkpoints {
+		cps[k] = v
+	}
+	return cps
+}
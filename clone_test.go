@@ -0,0 +1,122 @@
+/*
+Copyright 2016 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package workergroup
+
+import (
+	"reflect"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// field returns a settable view of the i-th field of the struct v points into, even if it is unexported.
+func field(v reflect.Value, i int) reflect.Value {
+	f := v.Field(i)
+	return reflect.NewAt(f.Type(), unsafe.Pointer(f.UnsafeAddr())).Elem()
+}
+
+// fill sets v to a non-zero value of its type, returning false for kinds it doesn't know how to fill. Slices and maps
+// are left out on purpose, as options holding them would need Clone to copy them rather than share them.
+func fill(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Bool:
+		v.SetBool(true)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(3)
+	case reflect.String:
+		v.SetString("set")
+	case reflect.Func:
+		v.Set(reflect.MakeFunc(v.Type(), func(args []reflect.Value) []reflect.Value {
+			results := make([]reflect.Value, v.Type().NumOut())
+			for i := range results {
+				results[i] = reflect.Zero(v.Type().Out(i))
+			}
+			return results
+		}))
+	case reflect.Interface:
+		candidates := []interface{}{ErrorPolicyFunc(func(err error, count int) bool { return true }), GobEncoder{},
+			time.Second}
+		for _, c := range candidates {
+			if c := reflect.ValueOf(c); c.Type().AssignableTo(v.Type()) {
+				v.Set(c)
+				return true
+			}
+		}
+		return false
+	default:
+		return false
+	}
+	return true
+}
+
+// same compares two values filled by fill. Functions can't be compared directly, so they are compared by pointer.
+func same(a, b reflect.Value) bool {
+	if a.Kind() == reflect.Interface {
+		a, b = a.Elem(), b.Elem()
+	}
+	if a.Kind() == reflect.Func {
+		return a.Pointer() == b.Pointer()
+	}
+	return reflect.DeepEqual(a.Interface(), b.Interface())
+}
+
+func TestCloneOptions(t *testing.T) {
+	wg := new(Group)
+	opts := reflect.ValueOf(&wg.opts).Elem()
+	for i := 0; i < opts.NumField(); i++ {
+		if !fill(field(opts, i)) {
+			t.Fatalf("Don't know how to set option %s (%v), update this test.", opts.Type().Field(i).Name,
+				opts.Type().Field(i).Type)
+		}
+	}
+
+	clone := wg.Clone()
+	copied := reflect.ValueOf(&clone.opts).Elem()
+	for i := 0; i < opts.NumField(); i++ {
+		if !same(field(opts, i), field(copied, i)) {
+			t.Errorf("Option %s was not copied by Clone.", opts.Type().Field(i).Name)
+		}
+	}
+}
+
+func TestCloneIndependent(t *testing.T) {
+	wg := new(Group)
+	wg.Add(1, func(abort <-chan bool, data interface{}) error { return nil })
+	wg.AddCleaner(func(data interface{}) {})
+	wg.AddFallback(func(abort <-chan bool, data interface{}, errs []error) error { return nil })
+	wg.AddFinalizer(func(abort <-chan bool, data interface{}) error { return nil })
+	wg.AddNode("a", nil, func(abort <-chan bool, data interface{}) error { return nil })
+
+	clone := wg.Clone()
+	clone.Add(1, func(abort <-chan bool, data interface{}) error { return nil })
+	clone.AddCleaner(func(data interface{}) {})
+	clone.AddFallback(func(abort <-chan bool, data interface{}, errs []error) error { return nil })
+	clone.AddFinalizer(func(abort <-chan bool, data interface{}) error { return nil })
+	clone.AddNode("b", nil, func(abort <-chan bool, data interface{}) error { return nil })
+	clone.SetMaxConcurrent(7)
+
+	if len(wg.workers) != 2 || len(wg.counts) != 2 || len(wg.cleaners) != 1 || len(wg.fallbacks) != 1 ||
+		len(wg.finalizers) != 1 || len(wg.nodes) != 1 || wg.opts.maxConcurrent != 0 {
+		t.Error("Changing the clone changed the original.")
+	}
+}
@@ -0,0 +1,357 @@
+/*
+Copyright 2016 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package workergroup
+
+import "sync"
+import "sync/atomic"
+import "time"
+
+// CollectorWorker is a Worker that also produces a result, see Group.AddCollector.
+type CollectorWorker func(abort <-chan bool, data interface{}) (interface{}, error)
+
+// AddCollector adds a CollectorWorker to the Group, see Add. The results returned by each copy are gathered by the
+// Instance, in the order the copies returned, and can be retrieved with Instance.Results (or are passed to the result
+// sink, see SetResultSink). Results from copies that returned an error are discarded.
+//
+// A result returned after the Instance started aborting is still kept, so a partial run retains everything that was
+// finished before the Workers gave up. The only results lost are those of Workers abandoned because of
+// SetStragglerGrace, which never return as far as the Instance is concerned.
+//
+// This covers the common "fan out, gather the outputs" case without having to set up a results channel and a consumer
+// Worker. If you need the results in a fixed order use Instance.Emit instead.
+func (wg *Group) AddCollector(count int, worker CollectorWorker) {
+	if worker == nil {
+		// Let Validate report it.
+		wg.add(count, nil)
+		return
+	}
+
+	wg.add(count, func(in *Instance, id, copy int, data interface{}) error {
+		result, err := in.collectBy(worker, data)
+		if err != nil {
+			return err
+		}
+
+		// run picks this up along with the Worker's return, so collecting is always done from one goroutine.
+		in.lock.Lock()
+		if in.collected == nil {
+			in.collected = map[int]interface{}{}
+		}
+		in.collected[id] = result
+		in.lock.Unlock()
+		return nil
+	})
+}
+
+// SetResultSink sets a function to be handed the result of each CollectorWorker (see AddCollector) as soon as it
+// returns, instead of it being kept for Instance.Results. This is for streaming or unbounded workloads, where holding
+// every result in memory isn't an option.
+//
+// The sink is called from the goroutine that manages the Instance, one result at a time, so it needs no locking of its
+// own. It does hold up the Instance noticing later Worker returns (and errors) while it runs, so a slow sink should
+// hand results off to something else, or be given a buffer with SetResultBufferPolicy. Pass nil to go back to
+// collecting results.
+func (wg *Group) SetResultSink(sink func(result interface{})) {
+	wg.opts.resultSink = sink
+}
+
+// SetResultValidator sets a function that checks each CollectorWorker result (see AddCollector) before it is accepted.
+// If it returns an error the result is discarded and the error is treated exactly as if the Worker had returned it,
+// so it is subject to the usual error handling (SetErrorThreshold, AbortIf, and so on). This keeps checks that
+// apply to every result in one place rather than in each Worker.
+//
+// Like the result sink the validator is called from the goroutine that manages the Instance, one result at a time, so
+// it should be cheap. Pass nil to accept every result.
+func (wg *Group) SetResultValidator(validate func(result interface{}) error) {
+	wg.opts.resultValidator = validate
+}
+
+// ResultBufferPolicy controls what happens when the result buffer is full, see SetResultBufferPolicy.
+type ResultBufferPolicy int
+
+const (
+	// BlockWhenFull holds up collecting further results until there is room in the buffer. Nothing is lost, but fast
+	// Workers are slowed to the pace of the sink.
+	BlockWhenFull ResultBufferPolicy = iota
+
+	// DropOldest throws away the oldest buffered result to make room for a new one, so collecting never waits.
+	DropOldest
+)
+
+// SetResultBufferPolicy bounds how many CollectorWorker results (see AddCollector) are held at once, and sets what
+// happens when there are more. A capacity <= 0 (the default) turns buffering off.
+//
+// With a result sink (see SetResultSink) the sink is called from a goroutine of its own, fed from a buffer of the given
+// capacity, so a slow sink no longer holds up the Instance. Once the buffer is full BlockWhenFull waits for the sink to
+// catch up, and DropOldest makes room by discarding the oldest result that has not reached the sink. Either way the
+// sink is still called one result at a time, and every buffered result is passed to it before the Cleaners run.
+//
+// Without a sink only DropOldest does anything, Instance.Results then holds just the newest capacity results. There is
+// nothing to wait for, so BlockWhenFull is the same as no limit.
+//
+// DropOldest trades completeness for liveness: it suits monitoring or sampling, where only recent results matter. The
+// results that are kept are still in the order they were collected, but there are gaps where results were dropped.
+// Instance.DroppedResults reports how many.
+func (wg *Group) SetResultBufferPolicy(capacity int, policy ResultBufferPolicy) {
+	wg.opts.resultBuffer = capacity
+	wg.opts.resultPolicy = policy
+}
+
+// DroppedResults returns how many results have been thrown away so far because of DropOldest, see
+// SetResultBufferPolicy. It may be called at any time.
+func (in *Instance) DroppedResults() int {
+	return int(in.dropped.Load())
+}
+
+// ResultCleaner is a Cleaner that is also given the results collected from the Instance's CollectorWorkers, see
+// Group.AddResultCleaner.
+type ResultCleaner func(data interface{}, results []interface{})
+
+// AddResultCleaner adds a Cleaner that receives every result collected from the CollectorWorkers (see AddCollector),
+// in the same order Instance.Results returns them. The Cleaners run after every Worker has returned, so the results
+// are complete, which makes this the place for "collect, then write it all out" work that would otherwise need a step
+// after Wait. If the Group has a result sink (see SetResultSink) the results are always empty.
+//
+// A ResultCleaner is like any other Cleaner: it always runs, and it runs in the order it was added relative to the
+// Cleaners added with AddCleaner, AddCleanerE, and friends. Each one gets its own copy of the results.
+func (wg *Group) AddResultCleaner(clean ResultCleaner) {
+	wg.cleaners = append(wg.cleaners, cleaner{withResults: clean, onSuccess: true, onFailure: true})
+}
+
+// SetResultDefault gives each CollectorWorker (see AddCollector) d to produce its result. A copy that hasn't returned
+// by then contributes value instead, and has its abort channel closed so it knows its result is no longer wanted. This
+// is for best effort aggregation within a time budget, where a missing value has a sensible stand in (such as zero).
+//
+// A Worker that ignores the abort keeps running, and the Instance still waits for it to return as usual. Whatever it
+// returns in the end, result or error, is thrown away in favor of value. A Worker that returns late because the whole
+// Instance aborted is not affected, its own result (or error) is kept. A d <= 0 (the default) turns this off.
+func (wg *Group) SetResultDefault(d time.Duration, value interface{}) {
+	wg.opts.resultDeadline = d
+	wg.opts.resultDefault = value
+}
+
+// collectBy runs a CollectorWorker, enforcing the result deadline (see SetResultDefault) if there is one.
+func (in *Instance) collectBy(worker CollectorWorker, data interface{}) (interface{}, error) {
+	if in.opts.resultDeadline <= 0 {
+		return worker(in.abort, data)
+	}
+
+	// abort is closed at the deadline (in which case expired is closed first) or when the Instance aborts.
+	abort := make(chan bool)
+	expired := make(chan bool)
+	returned := make(chan bool)
+	go func() {
+		t := time.NewTimer(in.opts.resultDeadline)
+		defer t.Stop()
+
+		select {
+		case <-t.C:
+			close(expired)
+		case <-in.abort:
+		case <-returned:
+			return
+		}
+		close(abort)
+	}()
+
+	result, err := worker(abort, data)
+	close(returned)
+	if Aborted(expired) {
+		return in.opts.resultDefault, nil
+	}
+	return result, err
+}
+
+// takeResult removes and returns the value a CollectorWorker left for run, if there is one.
+func (in *Instance) takeResult(id int) (interface{}, bool) {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+
+	v, ok := in.collected[id]
+	delete(in.collected, id)
+	return v, ok
+}
+
+// collect validates a CollectorWorker's result, then passes it to the sink or else adds it to the results (or the
+// spill file, see SetResultSpill). The error is the validator's or the spill file's, to be treated as the Worker's
+// error. Only call this from run.
+func (in *Instance) collect(v interface{}) error {
+	if in.opts.resultValidator != nil {
+		if err := in.opts.resultValidator(v); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case in.sinkQueue != nil:
+		in.sinkQueue.push(v)
+	case in.opts.resultSink != nil:
+		in.opts.resultSink(v)
+	default:
+		if spilled, err := in.spillResult(v); spilled {
+			return err
+		}
+
+		in.lock.Lock()
+		in.results = append(in.results, v)
+		if in.opts.resultPolicy == DropOldest && in.opts.resultBuffer > 0 && len(in.results) > in.opts.resultBuffer {
+			in.results[0] = nil
+			in.results = in.results[1:]
+			in.dropped.Add(1)
+		}
+		in.lock.Unlock()
+	}
+	return nil
+}
+
+// startSink starts the goroutine that feeds the sink from the result buffer, if the Group has both.
+func (in *Instance) startSink() {
+	if in.opts.resultSink == nil || in.opts.resultBuffer <= 0 {
+		return
+	}
+
+	in.sinkQueue = &resultQueue{capacity: in.opts.resultBuffer, policy: in.opts.resultPolicy, dropped: &in.dropped}
+	in.sinkQueue.changed.L = &in.sinkQueue.lock
+	in.sunk = make(chan bool)
+	go func() {
+		defer close(in.sunk)
+		for {
+			v, ok := in.sinkQueue.pop()
+			if !ok {
+				return
+			}
+			in.opts.resultSink(v)
+		}
+	}()
+}
+
+// stopSink waits for the sink to be given every buffered result. Only call this from run, once nothing else will be
+// collected.
+func (in *Instance) stopSink() {
+	if in.sinkQueue == nil {
+		return
+	}
+
+	in.sinkQueue.close()
+	<-in.sunk
+}
+
+// resultQueue is the result buffer between run and the sink, see SetResultBufferPolicy.
+type resultQueue struct {
+	lock    sync.Mutex
+	changed sync.Cond
+
+	items    []interface{}
+	capacity int
+	policy   ResultBufferPolicy
+	closed   bool
+
+	dropped *atomic.Int64
+}
+
+// push adds a result to the queue, waiting for room or dropping the oldest result if it is full.
+func (q *resultQueue) push(v interface{}) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for q.policy == BlockWhenFull && len(q.items) >= q.capacity {
+		q.changed.Wait()
+	}
+	if len(q.items) >= q.capacity {
+		q.items[0] = nil
+		q.items = q.items[1:]
+		q.dropped.Add(1)
+	}
+	q.items = append(q.items, v)
+	q.changed.Broadcast()
+}
+
+// pop removes the oldest result from the queue, waiting for one if it is empty. It returns false once the queue is
+// closed and empty.
+func (q *resultQueue) pop() (interface{}, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for len(q.items) == 0 && !q.closed {
+		q.changed.Wait()
+	}
+	if len(q.items) == 0 {
+		return nil, false
+	}
+
+	v := q.items[0]
+	q.items[0] = nil
+	q.items = q.items[1:]
+	q.changed.Broadcast()
+	return v, true
+}
+
+// close marks the queue as finished, pop returns false once it has handed out what is left.
+func (q *resultQueue) close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.closed = true
+	q.changed.Broadcast()
+}
+
+// collectedResults returns a copy of the results collected so far.
+func (in *Instance) collectedResults() []interface{} {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+	return append([]interface{}(nil), in.results...)
+}
+
+// Results blocks until the Instance is done, then returns the results from its CollectorWorkers (see AddCollector) in
+// the order they were returned. If the Group has a result sink (see SetResultSink) this is always empty.
+func (in *Instance) Results() []interface{} {
+	in.markWaited()
+	<-in.done
+	return in.collectedResults()
+}
+
+// MergeResults waits for every given Instance, then returns all of their results (see Instance.Results) as one slice
+// of R: the first Instance's results in order, then the second's, and so on. This is the gather step when the same
+// Group is run as several Instances, each over a shard of the input. Nil Instances and Instances without results are
+// skipped.
+//
+// Every result must be an R (or nil, which becomes the zero value), anything else panics like a failed type
+// assertion.
+func MergeResults[R any](instances ...*Instance) []R {
+	var merged []R
+	for _, in := range instances {
+		if in == nil {
+			continue
+		}
+
+		for _, r := range in.Results() {
+			if r == nil {
+				var zero R
+				merged = append(merged, zero)
+				continue
+			}
+			merged = append(merged, r.(R))
+		}
+	}
+	return merged
+}
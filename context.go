@@ -0,0 +1,130 @@
+/*
+Copyright 2016 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package workergroup
+
+import "context"
+import "errors"
+import "time"
+
+// ContextWorker is a Worker that is given a context.Context instead of an abort channel, for use with code that wants
+// one (HTTP clients, database drivers, and so on). The context is canceled when the Instance aborts, see
+// Instance.Context.
+type ContextWorker func(ctx context.Context, data interface{}) error
+
+// AddContext adds a ContextWorker to the Group, see Add.
+//
+// A ContextWorker that returns context.Canceled or context.DeadlineExceeded (or an error wrapping them) after the
+// Instance's context has been canceled is treated as having returned nil. Almost always that is just the Worker
+// passing on the abort, and it should not hide the error that actually caused it. Use SetContextErrorsFatal to turn
+// this off.
+func (wg *Group) AddContext(count int, worker ContextWorker) {
+	if worker == nil {
+		// Let Validate report it.
+		wg.add(count, nil)
+		return
+	}
+
+	wg.add(count, func(in *Instance, id, copy int, data interface{}) error {
+		err := worker(in.ctx, data)
+		if err != nil && !in.opts.contextErrorsFatal && in.ctx.Err() != nil {
+			if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+				return nil
+			}
+		}
+		return err
+	})
+}
+
+// SetContextErrorsFatal controls whether context errors returned by a ContextWorker after its context was canceled
+// are recorded as Worker errors. By default (false) they are treated as a clean return, see AddContext.
+func (wg *Group) SetContextErrorsFatal(fatal bool) {
+	wg.opts.contextErrorsFatal = fatal
+}
+
+// StartContext is like Start, except the Instance's context (see Instance.Context) is derived from ctx. If ctx is
+// canceled, or reaches its deadline, the Instance is aborted with the abort cause ContextCanceled and Wait returns
+// ctx.Err(), so you can tell it apart from NonErrorAbort. This happens even if SetAbortIsError(false) was used,
+// as the cancellation came from outside the Instance.
+//
+// ctx is not passed to the Workers as the data value, use Instance.Context or a ContextWorker to get at it. Values
+// stored in ctx are available from the derived context as usual.
+func (wg *Group) StartContext(ctx context.Context, data interface{}) *Instance {
+	return wg.startWith(ctx, data, wg.cleaners, nil, 0, 0)
+}
+
+// Context returns the Instance's context. It is canceled as soon as the Instance aborts, and context.Cause returns the
+// reason: the Worker (or health check) error that caused it, NonErrorAbort for an explicit abort (or the reason given
+// to AbortWith), or the parent context's cause if it came from StartContext (ErrTimeout or context.DeadlineExceeded for
+// a StartWithTimeout timeout). It is also canceled once the Instance is done, if it wasn't already.
+//
+// The context is derived from the one passed to StartContext, or from context.Background for the other ways of
+// starting an Instance.
+func (in *Instance) Context() context.Context {
+	return in.ctx
+}
+
+// Deadline returns the deadline of the Instance's context, see Instance.Context. This is the parent context's deadline
+// or the Instance's own timeout (see StartWithTimeout), whichever comes first. Workers can use this to size their own
+// timeouts, ok is false if there is no deadline.
+func (in *Instance) Deadline() (deadline time.Time, ok bool) {
+	return in.ctx.Deadline()
+}
+
+// WaitContext is Wait, except that it gives up early if ctx is canceled first, returning ctx.Err(). Giving up only
+// stops the waiting: the Instance is not aborted and its own error is unchanged, so the Workers carry on (or abort) on
+// their own schedule. If you want them to stop too call Abort (or start the Instance with StartContext).
+//
+// If the Instance finishes at the same time ctx is canceled the Instance's result wins.
+func (in *Instance) WaitContext(ctx context.Context) error {
+	in.markWaited()
+
+	select {
+	case <-in.failed:
+	case <-in.done:
+	case <-ctx.Done():
+		select {
+		case <-in.failed:
+		case <-in.done:
+		default:
+			return ctx.Err()
+		}
+	}
+	return in.Wait()
+}
+
+// watchContext aborts the Instance when the parent context is canceled. The watching goroutine exits when the
+// Instance finishes.
+func (in *Instance) watchContext(parent context.Context) {
+	if parent.Done() == nil {
+		// Never canceled, like context.Background.
+		return
+	}
+
+	go func() {
+		select {
+		case <-parent.Done():
+			in.failAbort(ContextCanceled, parent.Err())
+		case <-in.done:
+		}
+	}()
+}
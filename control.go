@@ -0,0 +1,83 @@
+/*
+Copyright 2016 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package workergroup
+
+// Command is a value sent to running ControlWorkers with Instance.Send. What a Command means is entirely up to your
+// Workers, the package never looks at them.
+type Command interface{}
+
+// ControlWorker is a Worker that also receives Commands sent to its Instance with Instance.Send. This allows things
+// like pausing, flushing, or reloading config in running Workers. The abort channel works exactly as it does for a
+// normal Worker.
+//
+// Each copy of a ControlWorker gets its own control channel, which is never closed.
+type ControlWorker func(abort <-chan bool, control <-chan Command, data interface{}) error
+
+// controlBuffer is the number of Commands each ControlWorker's channel can hold before Send starts dropping them.
+const controlBuffer = 16
+
+// AddControl adds a ControlWorker to the Group, see Add.
+func (wg *Group) AddControl(count int, worker ControlWorker) {
+	if worker == nil {
+		// Let Validate report it.
+		wg.add(count, nil)
+		return
+	}
+
+	wg.add(count, func(in *Instance, id, copy int, data interface{}) error {
+		control := make(chan Command, controlBuffer)
+
+		in.lock.Lock()
+		in.controls[control] = true
+		in.lock.Unlock()
+
+		defer func() {
+			in.lock.Lock()
+			delete(in.controls, control)
+			in.lock.Unlock()
+		}()
+
+		return worker(in.abort, control, data)
+	})
+}
+
+// Send delivers cmd to every running ControlWorker in the Instance and returns the number of Workers it was delivered
+// to.
+//
+// Send never blocks. Each ControlWorker's channel can buffer a few Commands, if a Worker is too slow to keep up and its
+// buffer is full the Command is dropped for that Worker. Workers that have not started yet, or have already returned,
+// do not receive the Command.
+func (in *Instance) Send(cmd Command) int {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+
+	sent := 0
+	for control := range in.controls {
+		select {
+		case control <- cmd:
+			sent++
+		default:
+		}
+	}
+	return sent
+}
@@ -0,0 +1,196 @@
+/*
+Copyright 2016 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package workergroup
+
+import "fmt"
+
+// node is a Worker added with AddNode.
+type node struct {
+	name string
+	deps []string
+
+	// index is the node's registration index.
+	index int
+}
+
+// DependencyError is returned in place of running a node when one of its dependencies failed, see Group.AddNode. It
+// unwraps to the dependency's error.
+type DependencyError struct {
+	Node, Dep string
+	Err       error
+}
+
+func (err *DependencyError) Error() string {
+	return fmt.Sprintf("Node %q was not run because its dependency %q failed: %v", err.Node, err.Dep, err.Err)
+}
+
+func (err *DependencyError) Unwrap() error {
+	return err.Err
+}
+
+// AddNode adds a single copy of a Worker that does not start until the named Workers it depends on have returned.
+// Together the nodes of a Group form a dependency graph, which is run in dependency order with as much parallelism as
+// the graph allows. Nodes can be mixed freely with normal Workers, which start right away as usual.
+//
+// Dependencies may be added in any order, they only need to exist by the time the Group is started. If one of a
+// node's dependencies returns an error the node is not run, it returns a *DependencyError instead (which unwraps to
+// the dependency's error, so nodes downstream of it get the same treatment). If the Instance is aborted while a node
+// is still waiting it is skipped and counts as having returned nil. The order nodes actually started in is recorded
+// in RunReport.NodeOrder.
+//
+// Duplicate names, unknown dependencies, and cycles are reported by Validate (and so by StartChecked). If a Group with
+// a broken graph is started anyway, every node returns the problem as its error rather than deadlocking.
+func (wg *Group) AddNode(name string, deps []string, worker Worker) {
+	if worker == nil {
+		// Let Validate report it.
+		wg.add(1, nil)
+		return
+	}
+
+	wg.nodes = append(wg.nodes, node{name: name, deps: append([]string(nil), deps...), index: len(wg.workers)})
+	wg.add(1, func(in *Instance, id, copy int, data interface{}) error {
+		return in.runNode(id, name, worker, data)
+	})
+}
+
+// runNode waits for a node's dependencies, then runs it.
+func (in *Instance) runNode(self int, name string, worker Worker, data interface{}) error {
+	if problems := in.group.graphProblems(); len(problems) > 0 {
+		return problems[0]
+	}
+
+	// The dependencies are waited on without a concurrency slot, or a node could hold the only slot while waiting on
+	// a dependency that needs it.
+	var err error
+	start := in.waitToStart(self, func() bool {
+		n, _ := in.group.node(name)
+		for _, dep := range n.deps {
+			d, _ := in.group.node(dep)
+			id := in.firstID(d.index)
+
+			returned, _ := in.returnedChan(id)
+			select {
+			case <-returned:
+			case <-in.abort:
+				return false
+			}
+
+			if derr := in.workerErr(id); derr != nil {
+				err = &DependencyError{Node: name, Dep: dep, Err: derr}
+				return false
+			}
+		}
+		return true
+	})
+	if !start {
+		return err
+	}
+
+	in.lock.Lock()
+	in.nodeOrder = append(in.nodeOrder, name)
+	in.lock.Unlock()
+
+	return worker(in.abort, data)
+}
+
+// firstID returns the ID of the first copy of the given registration.
+func (in *Instance) firstID(index int) int {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+
+	id := 0
+	for _, c := range in.group.counts[:index] {
+		id += c
+	}
+	return id
+}
+
+// node finds a node by name.
+func (wg *Group) node(name string) (node, bool) {
+	for _, n := range wg.nodes {
+		if n.name == name {
+			return n, true
+		}
+	}
+	return node{}, false
+}
+
+// graphProblems checks the dependency graph formed by the Group's nodes for duplicate names, unknown dependencies, and
+// cycles.
+func (wg *Group) graphProblems() []error {
+	problems := []error{}
+
+	seen := map[string]bool{}
+	for _, n := range wg.nodes {
+		if seen[n.name] {
+			problems = append(problems, fmt.Errorf("Node %q was added more than once.", n.name))
+		}
+		seen[n.name] = true
+	}
+
+	for _, n := range wg.nodes {
+		for _, dep := range n.deps {
+			if !seen[dep] {
+				problems = append(problems, fmt.Errorf("Node %q depends on %q, which does not exist.", n.name, dep))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		// Cycle detection assumes the names are sane.
+		return problems
+	}
+
+	// Depth first search, a node that is reached again while it is still on the stack is part of a cycle.
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := map[string]int{}
+	var visit func(name string) bool
+	visit = func(name string) bool {
+		switch state[name] {
+		case visiting:
+			return false
+		case visited:
+			return true
+		}
+
+		state[name] = visiting
+		n, _ := wg.node(name)
+		for _, dep := range n.deps {
+			if !visit(dep) {
+				return false
+			}
+		}
+		state[name] = visited
+		return true
+	}
+	for _, n := range wg.nodes {
+		if !visit(n.name) {
+			problems = append(problems, fmt.Errorf("Node %q is part of a dependency cycle.", n.name))
+			break
+		}
+	}
+	return problems
+}
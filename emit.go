@@ -0,0 +1,100 @@
+/*
+Copyright 2016 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package workergroup
+
+import "fmt"
+import "sort"
+
+// DuplicateSequenceError is returned by Emit when a result has already been emitted with the same sequence number.
+type DuplicateSequenceError struct {
+	Seq int
+}
+
+func (err *DuplicateSequenceError) Error() string {
+	return fmt.Sprintf("A result with sequence number %d was already emitted.", err.Seq)
+}
+
+// EmitWorker is a Worker that produces sequenced results with an Emitter, see Group.AddEmitter.
+type EmitWorker func(abort <-chan bool, data interface{}, emit *Emitter) error
+
+// Emitter is given to each EmitWorker, it emits results into the Worker's Instance.
+type Emitter struct {
+	in *Instance
+}
+
+// Emit records a result with the given sequence number, see Instance.Emit.
+func (e *Emitter) Emit(seq int, result interface{}) error {
+	return e.in.Emit(seq, result)
+}
+
+// AddEmitter adds an EmitWorker to the Group, see Add. Its results can be retrieved with Instance.EmittedResults.
+func (wg *Group) AddEmitter(count int, worker EmitWorker) {
+	if worker == nil {
+		// Let Validate report it.
+		wg.add(count, nil)
+		return
+	}
+
+	wg.add(count, func(in *Instance, id, copy int, data interface{}) error {
+		return worker(in.abort, data, &Emitter{in})
+	})
+}
+
+// Emit records a result with an explicit sequence number. Results are returned by EmittedResults sorted by sequence
+// number, so the final order depends only on the numbers your Workers assign (usually the index of the input item),
+// not on how many Workers there are or what order they finish in.
+//
+// If a result was already emitted with the same sequence number the new one is discarded and a
+// *DuplicateSequenceError is returned, Workers should normally return this so the Instance fails. Emit is safe to call
+// from many Workers at once. Workers added with AddEmitter call it through their Emitter.
+func (in *Instance) Emit(seq int, result interface{}) error {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+
+	if _, ok := in.emitted[seq]; ok {
+		return &DuplicateSequenceError{seq}
+	}
+	in.emitted[seq] = result
+	return nil
+}
+
+// EmittedResults blocks until the Instance is done, then returns every result passed to Emit, sorted by sequence
+// number. Gaps in the sequence are simply skipped.
+func (in *Instance) EmittedResults() []interface{} {
+	<-in.done
+
+	in.lock.Lock()
+	defer in.lock.Unlock()
+
+	seqs := make([]int, 0, len(in.emitted))
+	for seq := range in.emitted {
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+
+	results := make([]interface{}, len(seqs))
+	for i, seq := range seqs {
+		results[i] = in.emitted[seq]
+	}
+	return results
+}
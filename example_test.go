@@ -25,7 +25,7 @@ package workergroup_test
 import (
 	"fmt"
 	
-	worker "dctech/workergroup"
+	worker "github.com/milochristiansen/workergroup"
 )
 
 const total = 100
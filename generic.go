@@ -0,0 +1,93 @@
+/*
+Copyright 2016 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package workergroup
+
+// WorkerOf is a Worker with a statically typed data value, see GroupOf.
+type WorkerOf[T any] func(abort <-chan bool, data T) error
+
+// CleanerOf is a Cleaner with a statically typed data value, see GroupOf.
+type CleanerOf[T any] func(data T)
+
+// GroupOf is a Group whose data value has a fixed type, so Workers and Cleaners don't need to type assert it. Apart
+// from the data type it behaves exactly like a Group (it is just a thin wrapper around one), and the zero value is
+// ready to use.
+//
+// Only the common methods are wrapped. Settings and the less common variants are available on the underlying Group,
+// see GroupOf.Group.
+type GroupOf[T any] struct {
+	wg Group
+}
+
+// typed converts an untyped data value back to T. A nil data value becomes the zero value of T, which matters when T
+// is an interface type.
+func typed[T any](data interface{}) T {
+	v, _ := data.(T)
+	return v
+}
+
+// Group returns the underlying Group, for changing settings or using features that GroupOf does not wrap. Workers
+// added through it get the data value as an interface{} holding a T.
+func (g *GroupOf[T]) Group() *Group {
+	return &g.wg
+}
+
+// Add the given Worker to the Group, see Group.Add.
+func (g *GroupOf[T]) Add(count int, worker WorkerOf[T]) {
+	if worker == nil {
+		// Let Validate report it.
+		g.wg.Add(count, nil)
+		return
+	}
+
+	g.wg.Add(count, func(abort <-chan bool, data interface{}) error {
+		return worker(abort, typed[T](data))
+	})
+}
+
+// AddCleaner adds a Cleaner to the Group, see Group.AddCleaner.
+func (g *GroupOf[T]) AddCleaner(clean CleanerOf[T]) {
+	if clean == nil {
+		// Let Validate report it.
+		g.wg.AddCleaner(nil)
+		return
+	}
+
+	g.wg.AddCleaner(func(data interface{}) {
+		clean(typed[T](data))
+	})
+}
+
+// Validate checks the Group for problems, see Group.Validate.
+func (g *GroupOf[T]) Validate() error {
+	return g.wg.Validate()
+}
+
+// Start launches the Group, see Group.Start.
+func (g *GroupOf[T]) Start(data T) *Instance {
+	return g.wg.Start(data)
+}
+
+// Run launches the Group and waits for it, see Group.Run.
+func (g *GroupOf[T]) Run(data T) error {
+	return g.wg.Run(data)
+}
@@ -1,3 +1,3 @@
 module github.com/milochristiansen/workergroup
 
-go 1.16
+go 1.20
@@ -0,0 +1,66 @@
+/*
+Copyright 2016 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package workergroup
+
+import "time"
+
+// SetHealthCheck makes each Instance call check every interval while it is running, and abort if it ever returns an
+// error. This is for things outside the Workers that should stop the whole Group, such as a dependency going down.
+//
+// The check's error becomes the error Wait returns, the abort cause is HealthCheckFailed, and AbortCausingError
+// returns the error. It is not counted as a Worker error (see Instance.Errors), and the error policy is not consulted.
+// Checks stop as soon as the Instance is aborted for any reason.
+//
+// The check is called from its own goroutine, with the data value passed to Start. The goroutine exits when the
+// Instance is done. Pass a nil check (or an interval <= 0) to turn this off.
+func (wg *Group) SetHealthCheck(interval time.Duration, check func(data interface{}) error) {
+	wg.opts.healthInterval = interval
+	wg.opts.healthCheck = check
+}
+
+// watchHealth starts the health check goroutine, if the Group has a health check.
+func (in *Instance) watchHealth(data interface{}) {
+	check := in.opts.healthCheck
+	if check == nil || in.opts.healthInterval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(in.opts.healthInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := check(data); err != nil {
+					in.failAbort(HealthCheckFailed, err)
+					return
+				}
+			case <-in.abort:
+				return
+			case <-in.done:
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2016 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package workergroup
+
+import "reflect"
+import "sync"
+
+// WaitAll blocks until every given Instance is done, then returns their errors (as returned by Wait) in the same
+// order. Nil Instances are skipped and get a nil error.
+func WaitAll(instances ...*Instance) []error {
+	errs := make([]error, len(instances))
+	for i, in := range instances {
+		if in != nil {
+			errs[i] = in.Wait()
+		}
+	}
+	return errs
+}
+
+// WaitAny blocks until one of the given Instances is done, then returns its index and the error returned by its Wait.
+// If several are already done the one returned is chosen at random. Nil Instances are skipped, if there are no
+// non-nil Instances WaitAny returns -1 and nil immediately.
+func WaitAny(instances ...*Instance) (int, error) {
+	cases := make([]reflect.SelectCase, 0, len(instances))
+	indexes := make([]int, 0, len(instances))
+	for i, in := range instances {
+		if in == nil {
+			continue
+		}
+
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(in.done)})
+		indexes = append(indexes, i)
+	}
+	if len(cases) == 0 {
+		return -1, nil
+	}
+
+	chosen, _, _ := reflect.Select(cases)
+	i := indexes[chosen]
+	return i, instances[i].Wait()
+}
+
+// AbortAll calls Abort on every given Instance, skipping nil ones.
+func AbortAll(instances ...*Instance) {
+	for _, in := range instances {
+		if in != nil {
+			in.Abort()
+		}
+	}
+}
+
+// RunAll treats the given Instances as one unit, in the same way a Group treats its Workers: as soon as one of them
+// fails (its Wait returns an error) the rest are aborted. It blocks until every Wait has returned, then returns the
+// first error, or nil if they all succeeded. Nil Instances are skipped, and with no Instances RunAll returns nil right
+// away.
+//
+// Use WaitAll instead if you want every error without the aborts.
+func RunAll(instances ...*Instance) error {
+	var once sync.Once
+	var first error
+	var wg sync.WaitGroup
+	for _, in := range instances {
+		if in == nil {
+			continue
+		}
+
+		wg.Add(1)
+		go func(in *Instance) {
+			defer wg.Done()
+			if err := in.Wait(); err != nil {
+				once.Do(func() {
+					first = err
+					AbortAll(instances...)
+				})
+			}
+		}(in)
+	}
+	wg.Wait()
+	return first
+}
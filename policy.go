@@ -0,0 +1,106 @@
+/*
+Copyright 2016 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package workergroup
+
+// ErrorPolicy decides which Worker errors abort an Instance, see Group.SetErrorPolicy.
+//
+// Abort is called with each error returned by a Worker, along with count, the number of Worker errors the Instance
+// has received so far (including this one). If it returns true the error aborts the Instance and becomes the error
+// Wait returns, otherwise it is recorded (see Instance.Errors) but otherwise ignored.
+//
+// Abort is only ever called from the goroutine managing the Instance, one error at a time, but the same policy is used
+// by every Instance of the Group, so it should not keep state of its own. Everything it needs is in its arguments.
+type ErrorPolicy interface {
+	Abort(err error, count int) bool
+}
+
+// ErrorPolicyFunc adapts a plain function to the ErrorPolicy interface.
+type ErrorPolicyFunc func(err error, count int) bool
+
+func (f ErrorPolicyFunc) Abort(err error, count int) bool {
+	return f(err, count)
+}
+
+// SetErrorPolicy replaces the Group's error handling with the given policy. When a policy is set AbortIf and
+// SetErrorThreshold are ignored (and so is OnThresholdExceeded), the policy alone decides. Pass nil to go back to
+// using them.
+//
+// The old options map onto policies like so: AbortIf(f) is PredicatePolicy(f), and SetErrorThreshold(n) is
+// ThresholdPolicy(n). The one difference is that with the options only errors that pass the predicate count towards
+// the threshold, where count always includes every error. Build more complex rules with AnyOf and AllOf, for example
+// "abort on any permission error, or once five errors of any kind have arrived":
+//
+//	wg.SetErrorPolicy(workergroup.AnyOf(
+//		workergroup.PredicatePolicy(func(err error) bool { return errors.Is(err, fs.ErrPermission) }),
+//		workergroup.ThresholdPolicy(5),
+//	))
+func (wg *Group) SetErrorPolicy(policy ErrorPolicy) {
+	wg.opts.errorPolicy = policy
+}
+
+// FirstErrorPolicy aborts on the first error. This is the default behavior.
+func FirstErrorPolicy() ErrorPolicy {
+	return ErrorPolicyFunc(func(err error, count int) bool {
+		return true
+	})
+}
+
+// PredicatePolicy aborts on errors for which fatal returns true.
+func PredicatePolicy(fatal func(err error) bool) ErrorPolicy {
+	return ErrorPolicyFunc(func(err error, count int) bool {
+		return fatal(err)
+	})
+}
+
+// ThresholdPolicy aborts once n errors have been received. Zero or one is the same as FirstErrorPolicy.
+func ThresholdPolicy(n int) ErrorPolicy {
+	return ErrorPolicyFunc(func(err error, count int) bool {
+		return count >= n
+	})
+}
+
+// AnyOf aborts if any of the given policies would. They are checked in order, and checking stops at the first one that
+// returns true. With no policies it never aborts.
+func AnyOf(policies ...ErrorPolicy) ErrorPolicy {
+	return ErrorPolicyFunc(func(err error, count int) bool {
+		for _, p := range policies {
+			if p.Abort(err, count) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// AllOf aborts only if every one of the given policies would. They are checked in order, and checking stops at the
+// first one that returns false. With no policies it always aborts.
+func AllOf(policies ...ErrorPolicy) ErrorPolicy {
+	return ErrorPolicyFunc(func(err error, count int) bool {
+		for _, p := range policies {
+			if !p.Abort(err, count) {
+				return false
+			}
+		}
+		return true
+	})
+}
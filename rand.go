@@ -0,0 +1,84 @@
+/*
+Copyright 2016 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package workergroup
+
+import "math/rand"
+import "sync"
+import "time"
+
+// SetRandSeed makes every Instance of the Group seed its Rand (see Instance.Rand) with the given value, so runs that
+// use it are repeatable in tests. By default each Instance is seeded from the current time.
+func (wg *Group) SetRandSeed(seed int64) {
+	wg.opts.randSeed = seed
+	wg.opts.seeded = true
+}
+
+// Rand returns the Instance's random number generator. It is shared by every Worker (use AddWithInstance to give a
+// Worker its Instance), so Workers don't need to create their own sources, which tend to end up with the same time
+// based seed when many of them are launched at once. The generator is created the first time Rand is called.
+//
+// Every method is safe for concurrent use except Read, which keeps unlocked state of its own in *rand.Rand. Don't call
+// Read from more than one Worker at once, use Int63 or Uint64 to fill byte slices instead.
+//
+// Note that a fixed seed (see SetRandSeed) only fixes the sequence of numbers, not which Worker gets which one. When
+// several Workers draw from it at once the split depends on scheduling. If each Worker needs its own repeatable
+// stream, draw a seed for each of them before starting the Instance, or have a single Worker use it.
+func (in *Instance) Rand() *rand.Rand {
+	in.rngOnce.Do(func() {
+		in.rng = newRand(in.opts)
+	})
+	return in.rng
+}
+
+// newRand creates the Rand for a new Instance.
+func newRand(opts options) *rand.Rand {
+	seed := opts.randSeed
+	if !opts.seeded {
+		seed = time.Now().UnixNano()
+	}
+	return rand.New(&lockedSource{src: rand.NewSource(seed).(rand.Source64)})
+}
+
+// lockedSource makes a rand.Source safe for concurrent use, like the one behind the top level functions in math/rand.
+type lockedSource struct {
+	lock sync.Mutex
+	src  rand.Source64
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Uint64() uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.src.Uint64()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.src.Seed(seed)
+}
@@ -0,0 +1,189 @@
+/*
+Copyright 2016 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package workergroup
+
+import "runtime"
+import "strconv"
+import "strings"
+import "time"
+
+// RunReport holds per-Worker details about a finished Instance.
+type RunReport struct {
+	// Workers has one entry for every Worker copy launched by the Instance, in launch order. Copies of the same
+	// registration are next to each other, and registrations are in the order they were added to the Group.
+	Workers []WorkerReport
+
+	// Elapsed is the time from Start until the Instance was done, including the Cleaners.
+	Elapsed time.Duration
+
+	// TooShort is true if the Instance failed sooner than the Group's minimum run duration, see
+	// Group.SetMinRunDuration.
+	TooShort bool
+
+	// Tags is a copy of the Instance's tags as they were when it finished, see Instance.SetTag.
+	Tags map[string]string
+
+	// NodeOrder holds the names of the nodes (see Group.AddNode) that were run, in the order they started.
+	NodeOrder []string
+
+	// Retries is how many times Workers added with Group.AddRetry were run again, see Group.SetTotalRetryBudget.
+	Retries int
+}
+
+// WorkerReport describes how a single Worker copy returned.
+type WorkerReport struct {
+	// Index is the index of the registration (the call to Group.Add) this copy belongs to.
+	Index int
+
+	// Copy is which copy of the registration this is, from 0 to count-1.
+	Copy int
+
+	// Err is the value returned by the Worker.
+	Err error
+
+	// AfterAbort is true if the abort channel had already been closed when the Worker returned.
+	//
+	// This lets you tell errors that caused an abort from errors that were (most likely) caused by it. A Worker
+	// whose error ordered the abort will always have this set to false. A Worker that returns an error with this
+	// set was racing the abort, and its error is probably only interesting if there is no better one.
+	AfterAbort bool
+
+	// Duration is the wall clock time the Worker ran for. It is zero for abandoned Workers.
+	Duration time.Duration
+
+	// Abandoned is true if the Instance stopped waiting for this Worker, see Group.SetStragglerGrace.
+	Abandoned bool
+}
+
+// SlowestWorker returns the ID (index into Workers) and report of the Worker copy that ran the longest. If several
+// copies tie the one with the lowest ID wins. If the report has no Workers the returned ID is -1.
+func (r RunReport) SlowestWorker() (int, WorkerReport) {
+	slowest := -1
+	for i, w := range r.Workers {
+		if slowest == -1 || w.Duration > r.Workers[slowest].Duration {
+			slowest = i
+		}
+	}
+	if slowest == -1 {
+		return -1, WorkerReport{}
+	}
+	return slowest, r.Workers[slowest]
+}
+
+// Report returns the RunReport for this Instance. Like Wait this will block until all Workers return.
+func (in *Instance) Report() RunReport {
+	in.markWaited()
+	<-in.done
+	return in.report
+}
+
+// WaitReport blocks until all Workers have returned and the Cleaners have run, then returns both the RunReport and
+// the error Wait would return. This is simply a shortcut for calling Wait and Report separately.
+func (in *Instance) WaitReport() (RunReport, error) {
+	report := in.Report()
+	return report, in.Wait()
+}
+
+// RetryFailed starts a new Instance of the same Group containing only the Worker copies that returned an error in this
+// Instance. If a registration had three copies and two of them failed, the new Instance will run two copies of it.
+// The Group's Cleaners and settings are the same as they were when this Instance was started.
+//
+// RetryFailed blocks until this Instance is finished. If no Workers failed the returned Instance will have no Workers
+// (see Group.Start for how that case is handled).
+func (in *Instance) RetryFailed(data interface{}) *Instance {
+	report := in.Report()
+
+	failed := make([]int, len(in.group.workers))
+	for _, w := range report.Workers {
+		if w.Err != nil {
+			failed[w.Index]++
+		}
+	}
+
+	wg := &Group{
+		cleaners:   in.group.cleaners,
+		fallbacks:  in.group.fallbacks,
+		finalizers: in.group.finalizers,
+		opts:       in.group.opts,
+	}
+	indexes := map[int]int{}
+	for i, count := range failed {
+		if count > 0 {
+			indexes[i] = len(wg.workers)
+			wg.counts = append(wg.counts, count)
+			wg.workers = append(wg.workers, in.group.workers[i])
+		}
+	}
+
+	// Retried nodes only need to wait for dependencies that are also being retried, the others already succeeded.
+	for _, n := range in.group.nodes {
+		index, ok := indexes[n.index]
+		if !ok {
+			continue
+		}
+
+		deps := []string{}
+		for _, dep := range n.deps {
+			if d, _ := in.group.node(dep); failed[d.index] > 0 {
+				deps = append(deps, dep)
+			}
+		}
+		wg.nodes = append(wg.nodes, node{name: n.name, deps: deps, index: index})
+	}
+	return wg.Start(data)
+}
+
+// GoroutineIDs returns a map of Worker IDs (indexes in RunReport.Workers) to the ID of the goroutine running that
+// Worker, so you can find a specific Worker in a stack dump. Workers are added as they start. This only works if
+// the Group had Group.SetDebugGoroutineIDs turned on, otherwise the map is always empty.
+//
+// Go does not officially expose goroutine IDs, they are found by parsing the header of the goroutine's stack trace.
+// This is best effort only, and may stop working in future Go versions (in which case the IDs will be -1). Do not
+// use this for anything but debugging!
+func (in *Instance) GoroutineIDs() map[int]int64 {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+
+	ids := make(map[int]int64, len(in.goroutines))
+	for k, v := range in.goroutines {
+		ids[k] = v
+	}
+	return ids
+}
+
+// goroutineID returns the ID of the calling goroutine, or -1 if it can't be found.
+func goroutineID() int64 {
+	// The first line of the stack trace looks like "goroutine 123 [running]:".
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+
+	fields := strings.Fields(string(buf))
+	if len(fields) < 2 || fields[0] != "goroutine" {
+		return -1
+	}
+	id, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return id
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2016 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package workergroup
+
+import "context"
+import "errors"
+
+// RunError is returned by Wait, WaitDrain, and OnDone callbacks (and everything built on them, such as Run) when the
+// Group has SetRunErrors turned on. It bundles the error Wait would normally return with the details of how the
+// Instance failed, so callers don't need to keep the Instance around to inspect it.
+//
+// RunError unwraps to the error Wait would have returned, so errors.Is(err, NonErrorAbort), IsAbort, and checks
+// against Worker errors all keep working.
+type RunError struct {
+	// Err is the error Wait would have returned without SetRunErrors.
+	Err error
+
+	cause AbortCause
+	errs  []error
+}
+
+func (err *RunError) Error() string {
+	return err.Err.Error()
+}
+
+func (err *RunError) Unwrap() error {
+	return err.Err
+}
+
+// Aborted returns true if the Instance was aborted, for any reason.
+func (err *RunError) Aborted() bool {
+	return err.cause != NotAborted
+}
+
+// TimedOut returns true if the Instance hit its timeout (see Group.StartWithTimeout), or if the error or any of the
+// Worker errors is (or wraps) context.DeadlineExceeded.
+func (err *RunError) TimedOut() bool {
+	if err.cause == TimedOut || errors.Is(err.Err, context.DeadlineExceeded) {
+		return true
+	}
+	for _, e := range err.errs {
+		if errors.Is(e, context.DeadlineExceeded) {
+			return true
+		}
+	}
+	return false
+}
+
+// Cause returns why the Instance was aborted, see Instance.AbortCause.
+func (err *RunError) Cause() AbortCause {
+	return err.cause
+}
+
+// WorkerErrors returns every error returned by a Worker, in the order they were received, see Instance.Errors. In
+// fail fast mode this only includes the errors received before Wait returned.
+func (err *RunError) WorkerErrors() []error {
+	return append([]error(nil), err.errs...)
+}
+
+// SetRunErrors controls whether Wait, WaitDrain, and OnDone wrap the errors they return in a *RunError. Use errors.As
+// to get at it. This is off by default, so errors returned by Workers are returned as is.
+func (wg *Group) SetRunErrors(enabled bool) {
+	wg.opts.runErrors = enabled
+}
+
+// runError wraps err in a RunError if the Group asked for it.
+func (in *Instance) runError(err error) error {
+	if err == nil || !in.opts.runErrors {
+		return err
+	}
+	return &RunError{Err: err, cause: in.AbortCause(), errs: in.Errors()}
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2016 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package workergroup
+
+import "math/rand"
+import "sync"
+import "time"
+
+// RunEvery starts a new Instance of the Group every interval until the returned stop function is called. Each
+// Instance gets a fresh data value from the given factory function (which may be nil, in which case nil is passed).
+//
+// If the previous Instance is still running when a tick comes around that tick is skipped, there is never more than
+// one scheduled Instance running at a time. The schedule does not wait for the current Instance before counting down
+// to the next tick, so a slow run just causes ticks to be skipped rather than shifting the schedule.
+//
+// If the Group has a minimum run duration (see SetMinRunDuration) and a run fails too quickly, ticks are skipped until
+// that much time has passed since the failed run finished.
+//
+// The Group is copied when RunEvery is called, so later changes to it do not affect the schedule. Calling stop halts
+// the schedule, aborts the running Instance (if any), and waits for it to finish. It is safe to call stop more than
+// once.
+func (wg *Group) RunEvery(interval time.Duration, data func() interface{}) (stop func()) {
+	return wg.schedule(func() time.Duration { return interval }, data)
+}
+
+// RunEveryJitter is like RunEvery, except a random delay between zero and jitter is added to each interval. This
+// spreads out the load when many processes run the same schedule, so they don't all start at once.
+//
+// Random delays are drawn from rng, pass a source with a fixed seed to get a repeatable schedule in tests. If rng is
+// nil a source seeded from the current time is used. rng is only used by the scheduling goroutine, so it does not
+// need to be safe for concurrent use (but it must not be shared with anything else).
+func (wg *Group) RunEveryJitter(interval, jitter time.Duration, rng *rand.Rand, data func() interface{}) (stop func()) {
+	if rng == nil {
+		rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+
+	return wg.schedule(func() time.Duration {
+		if jitter <= 0 {
+			return interval
+		}
+		return interval + time.Duration(rng.Int63n(int64(jitter)+1))
+	}, data)
+}
+
+// schedule runs the Group repeatedly, waiting for the duration returned by next before each run.
+func (wg *Group) schedule(next func() time.Duration, data func() interface{}) (stop func()) {
+	g := *wg
+
+	quit := make(chan bool)
+	finished := make(chan bool)
+	go func() {
+		defer close(finished)
+
+		var current *Instance
+		timer := time.NewTimer(next())
+		defer timer.Stop()
+		for {
+			select {
+			case <-quit:
+				if current != nil {
+					current.Close()
+				}
+				return
+			case <-timer.C:
+				timer.Reset(next())
+				if current != nil && !current.Done() {
+					continue
+				}
+				if current != nil && current.report.TooShort && time.Since(current.finished) < g.opts.minRunDuration {
+					// The last run failed too quickly, give it some time before trying again.
+					continue
+				}
+
+				var d interface{}
+				if data != nil {
+					d = data()
+				}
+				current = g.Start(d)
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(quit)
+		})
+		<-finished
+	}
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2016 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package workergroup
+
+import "sync"
+
+// SetScheduler sets the function that picks which queued Worker runs next when a slot frees up under SetMaxConcurrent.
+// It is given the IDs (indexes in RunReport.Workers) of the waiting Workers, in the order they started waiting, and
+// returns the one to run. IDs are handed out in the order the Workers were added, so a scheduler can map them back to
+// priorities, tenants, or whatever it is balancing. Returning something that isn't in waiting runs the first Worker in
+// the slice. Pass nil for the default, which is first come, first served.
+//
+// The scheduler is called with the Instance's slot queue locked, from whichever goroutine is giving up the slot, so it
+// must be quick and must not block or call back into the Instance. It is entirely in charge of the order: one that
+// keeps passing over a Worker will starve it, and the Instance cannot finish until every Worker has run. The
+// scheduler has no effect without SetMaxConcurrent.
+func (wg *Group) SetScheduler(pick func(waiting []int) int) {
+	wg.opts.scheduler = pick
+}
+
+// slots limits how many Workers run at once, see SetMaxConcurrent and SetScheduler.
+type slots struct {
+	lock sync.Mutex
+	free int
+
+	// waiting holds the IDs of the queued Workers in the order they arrived, ready the channel each one is waiting
+	// on. A Worker is given a slot by removing it from both and closing its channel.
+	waiting []int
+	ready   map[int]chan bool
+
+	pick func(waiting []int) int
+}
+
+func newSlots(n int, pick func(waiting []int) int) *slots {
+	return &slots{free: n, ready: map[int]chan bool{}, pick: pick}
+}
+
+// acquire waits for a slot for the given Worker, returning false if abort is closed first. A nil abort waits forever.
+func (s *slots) acquire(id int, abort <-chan bool) bool {
+	s.lock.Lock()
+	if s.free > 0 && len(s.waiting) == 0 {
+		s.free--
+		s.lock.Unlock()
+		return true
+	}
+
+	ready := make(chan bool)
+	s.waiting = append(s.waiting, id)
+	s.ready[id] = ready
+	s.lock.Unlock()
+
+	select {
+	case <-ready:
+		return true
+	case <-abort:
+	}
+
+	s.lock.Lock()
+	if _, queued := s.ready[id]; queued {
+		s.remove(id)
+		s.lock.Unlock()
+		return false
+	}
+	s.lock.Unlock()
+
+	// The slot was handed over at the same time as the abort, pass it on.
+	s.release()
+	return false
+}
+
+// release gives up a slot, handing it straight to the next queued Worker if there is one.
+func (s *slots) release() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.waiting) == 0 {
+		s.free++
+		return
+	}
+
+	next := s.waiting[0]
+	if s.pick != nil {
+		if id := s.pick(append([]int(nil), s.waiting...)); s.ready[id] != nil {
+			next = id
+		}
+	}
+	ready := s.ready[next]
+	s.remove(next)
+	close(ready)
+}
+
+// remove takes a Worker out of the queue. The lock must be held.
+func (s *slots) remove(id int) {
+	delete(s.ready, id)
+	for i, w := range s.waiting {
+		if w == id {
+			s.waiting = append(s.waiting[:i], s.waiting[i+1:]...)
+			return
+		}
+	}
+}
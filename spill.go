@@ -0,0 +1,228 @@
+/*
+Copyright 2016 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package workergroup
+
+import "bufio"
+import "bytes"
+import "encoding/gob"
+import "io"
+import "os"
+
+// Encoder writes CollectorWorker results to the spill file and reads them back, see SetResultSpill.
+type Encoder interface {
+	// Encode writes v to w.
+	Encode(w io.Writer, v interface{}) error
+
+	// Decode reads back the next value written by Encode. r is buffered (it is also an io.ByteReader), so Decode should
+	// not wrap it in a buffer of its own or it may read past the value.
+	Decode(r io.Reader) (interface{}, error)
+}
+
+// GobEncoder is an Encoder that uses encoding/gob. The results are encoded as interface values, so the concrete type
+// of every result (other than the built in types) must be registered with gob.Register.
+type GobEncoder struct{}
+
+func (GobEncoder) Encode(w io.Writer, v interface{}) error {
+	return gob.NewEncoder(w).Encode(&v)
+}
+
+func (GobEncoder) Decode(r io.Reader) (interface{}, error) {
+	var v interface{}
+	err := gob.NewDecoder(r).Decode(&v)
+	return v, err
+}
+
+// SetResultSpill bounds the memory used by CollectorWorker results (see AddCollector). The first threshold results are
+// kept in memory as usual, every one after that is written to a temporary file with enc (a GobEncoder if enc is nil).
+// A threshold <= 0 (the default) turns spilling off. If the Group has a result sink (see SetResultSink) the results go
+// to the sink instead, and nothing is spilled.
+//
+// Instance.Results and the ResultCleaners only see the results held in memory. To read all of them, in order, use an
+// IteratorCleaner (see AddIteratorCleaner). The spill file is removed once the Cleaners have run, so that is the only
+// place the spilled results can be read.
+//
+// A result that can't be written to the spill file is treated as if the Worker had returned the error, so it is
+// subject to the usual error handling, the same as a result rejected by the validator (see SetResultValidator).
+func (wg *Group) SetResultSpill(threshold int, enc Encoder) {
+	if enc == nil {
+		enc = GobEncoder{}
+	}
+	wg.opts.spillThreshold = threshold
+	wg.opts.spillEncoder = enc
+}
+
+// IteratorCleaner is a Cleaner that is also given an iterator over the results collected from the Instance's
+// CollectorWorkers, spilled ones included, see Group.AddIteratorCleaner.
+type IteratorCleaner func(data interface{}, results *ResultIterator)
+
+// AddIteratorCleaner adds a Cleaner that may read every CollectorWorker result (see AddCollector), including the ones
+// spilled to disk (see SetResultSpill), without loading them all into memory. The results are in the same order as
+// for a ResultCleaner, and each IteratorCleaner gets an iterator of its own that starts at the first result.
+//
+// The iterator is only good until the Cleaner returns, don't keep it around. Otherwise an IteratorCleaner is like any
+// other Cleaner.
+func (wg *Group) AddIteratorCleaner(clean IteratorCleaner) {
+	wg.cleaners = append(wg.cleaners, cleaner{withIterator: clean, onSuccess: true, onFailure: true})
+}
+
+// ResultIterator reads back the results collected from an Instance's CollectorWorkers, see AddIteratorCleaner.
+//
+// Use it like a bufio.Scanner:
+//
+//	for results.Next() {
+//		use(results.Value())
+//	}
+//	if err := results.Err(); err != nil {
+//		// Some of the spilled results could not be read.
+//	}
+type ResultIterator struct {
+	memory []interface{}
+
+	// name is the spill file, and left is how many results in it have not been read yet.
+	name string
+	left int
+	enc  Encoder
+
+	file *os.File
+	r    *bufio.Reader
+
+	value interface{}
+	err   error
+}
+
+// Next moves to the next result, which is then returned by Value. It returns false once there are no more results or
+// one could not be read, see Err.
+func (it *ResultIterator) Next() bool {
+	it.value = nil
+	if it.err != nil {
+		return false
+	}
+
+	if len(it.memory) > 0 {
+		it.value = it.memory[0]
+		it.memory = it.memory[1:]
+		return true
+	}
+
+	if it.left == 0 {
+		return false
+	}
+	if it.file == nil {
+		it.file, it.err = os.Open(it.name)
+		if it.err != nil {
+			return false
+		}
+		it.r = bufio.NewReader(it.file)
+	}
+
+	it.value, it.err = it.enc.Decode(it.r)
+	if it.err != nil {
+		it.value = nil
+		return false
+	}
+	it.left--
+	return true
+}
+
+// Value returns the current result, see Next.
+func (it *ResultIterator) Value() interface{} {
+	return it.value
+}
+
+// Err returns the error that stopped Next, if any.
+func (it *ResultIterator) Err() error {
+	return it.err
+}
+
+// close closes the spill file, if the iterator opened it.
+func (it *ResultIterator) close() {
+	if it.file != nil {
+		it.file.Close()
+	}
+}
+
+// resultIterator returns a new iterator over every result collected so far. Only call this once collection is done.
+func (in *Instance) resultIterator() *ResultIterator {
+	it := &ResultIterator{memory: in.collectedResults(), left: in.spilled, enc: in.opts.spillEncoder}
+	if in.spill != nil {
+		it.name = in.spill.file.Name()
+	}
+	return it
+}
+
+// spillFile is where results go once there are more than the threshold, see SetResultSpill.
+type spillFile struct {
+	file *os.File
+	w    *bufio.Writer
+}
+
+// spillResult writes v to the spill file (creating it if needed) if the results held in memory are at the threshold.
+// It returns false if v should be kept in memory instead. Only call this from run.
+func (in *Instance) spillResult(v interface{}) (bool, error) {
+	if in.opts.spillThreshold <= 0 || len(in.results) < in.opts.spillThreshold {
+		return false, nil
+	}
+
+	if in.spill == nil {
+		f, err := os.CreateTemp("", "workergroup-spill-")
+		if err != nil {
+			return true, err
+		}
+		in.spill = &spillFile{file: f, w: bufio.NewWriter(f)}
+	}
+
+	// Encode to a buffer first, so a value that fails halfway doesn't leave half a value in the file.
+	var buf bytes.Buffer
+	if err := in.opts.spillEncoder.Encode(&buf, v); err != nil {
+		return true, err
+	}
+	if _, err := in.spill.w.Write(buf.Bytes()); err != nil {
+		return true, err
+	}
+	in.spilled++
+	return true, nil
+}
+
+// stopSpill flushes the spill file, so the results in it can be read. Only call this from run, once nothing else will
+// be collected.
+func (in *Instance) stopSpill() {
+	if in.spill == nil {
+		return
+	}
+
+	if err := in.spill.w.Flush(); err != nil {
+		in.lock.Lock()
+		in.cleanErrs = append(in.cleanErrs, err)
+		in.lock.Unlock()
+	}
+}
+
+// removeSpill closes and removes the spill file once the Cleaners are done with it.
+func (in *Instance) removeSpill() {
+	if in.spill == nil {
+		return
+	}
+
+	in.spill.file.Close()
+	os.Remove(in.spill.file.Name())
+}
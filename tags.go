@@ -0,0 +1,48 @@
+/*
+Copyright 2016 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package workergroup
+
+// SetTag attaches a key/value pair to the Instance, replacing any previous value for the key. Tags are not used by the
+// Instance itself, they are just a convenient place to keep things like request IDs so logging and monitoring code
+// that is handed an Instance can tell which one it is.
+//
+// SetTag may be called at any time, from any goroutine. Tags set before the Instance is done are copied into its
+// RunReport.
+func (in *Instance) SetTag(key, value string) {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+
+	in.tags[key] = value
+}
+
+// Tags returns a copy of the Instance's tags.
+func (in *Instance) Tags() map[string]string {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+
+	tags := make(map[string]string, len(in.tags))
+	for k, v := range in.tags {
+		tags[k] = v
+	}
+	return tags
+}
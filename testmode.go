@@ -0,0 +1,106 @@
+/*
+Copyright 2016 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package workergroup
+
+import "fmt"
+import "sync"
+
+// TestController runs an Instance's Workers one at a time, in an order chosen by the caller. This makes tests of
+// ordering dependent behavior reproducible. See Group.SetTestMode.
+//
+// Each Worker runs to completion in the goroutine that calls Step or RunAll, so Workers that wait on each other (for
+// example a consumer that blocks until a producer sends something) will deadlock under a TestController. It works best
+// for Workers that can each finish on their own.
+type TestController struct {
+	lock    sync.Mutex
+	pending []func()
+}
+
+// SetTestMode makes the Group's Instances hand their Workers to ctl rather than launching them, see TestController.
+// This replaces any spawner set with SetSpawner. Pass nil to go back to normal goroutines.
+func (wg *Group) SetTestMode(ctl *TestController) {
+	if ctl == nil {
+		wg.SetSpawner(nil)
+		return
+	}
+	wg.SetSpawner(ctl.spawn)
+}
+
+func (ctl *TestController) spawn(fn func()) {
+	ctl.lock.Lock()
+	ctl.pending = append(ctl.pending, fn)
+	ctl.lock.Unlock()
+}
+
+// Pending returns the number of Workers waiting to be run. Workers are queued in launch order, the same order they
+// appear in RunReport.Workers.
+func (ctl *TestController) Pending() int {
+	ctl.lock.Lock()
+	defer ctl.lock.Unlock()
+	return len(ctl.pending)
+}
+
+// Step runs the i-th pending Worker and removes it from the queue. Step returns after the Worker returns. Step panics
+// if i is out of range.
+func (ctl *TestController) Step(i int) {
+	ctl.lock.Lock()
+	fn := ctl.pending[i]
+	ctl.pending = append(ctl.pending[:i], ctl.pending[i+1:]...)
+	ctl.lock.Unlock()
+
+	fn()
+}
+
+// RunAll runs every pending Worker in the order they were queued.
+func (ctl *TestController) RunAll() {
+	for ctl.Pending() > 0 {
+		ctl.Step(0)
+	}
+}
+
+// RunSync runs the Group one Worker at a time, in registration order, in the calling goroutine, then returns the error
+// Wait would return. Every registration must have a count of exactly one, otherwise nothing is run and an error is
+// returned. This is for unit testing Worker bodies, where the normal scheduling makes failures hard to reproduce.
+//
+// Each Worker's result is fully handled before the next Worker starts, so if a Worker returns an error that aborts the
+// Instance every Worker after it will see a closed abort channel. Cleaners run as normal once the last Worker returns.
+// As with a TestController, a Worker that waits for another Worker (or for an abort that never comes) will deadlock.
+func (wg *Group) RunSync(data interface{}) error {
+	for i, c := range wg.counts {
+		if c != 1 {
+			return fmt.Errorf("RunSync requires every Worker to have a count of one, Worker %d has a count of %d.", i, c)
+		}
+	}
+
+	g := wg.Clone()
+	ctl := new(TestController)
+	g.SetTestMode(ctl)
+
+	in := g.Start(data)
+	for id := 0; ctl.Pending() > 0; id++ {
+		ctl.Step(0)
+		returned, _ := in.returnedChan(id)
+		<-returned
+	}
+	return in.Wait()
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2016 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package workergroup
+
+import "strconv"
+import "time"
+
+// EventKind identifies what happened in a timeline Event.
+type EventKind int
+
+const (
+	// WorkerStarted is recorded right before a Worker is called. ID is the Worker's ID.
+	WorkerStarted EventKind = iota
+
+	// WorkerFinished is recorded right after a Worker returns. ID is the Worker's ID and Err is what it returned.
+	WorkerFinished
+
+	// AbortOrdered is recorded when the Instance is aborted. Cause is why, and Err is the Worker error that caused
+	// it (if any).
+	AbortOrdered
+
+	// CleanerStarted is recorded right before a Cleaner is called. ID is the Cleaner's index.
+	CleanerStarted
+
+	// CleanerFinished is recorded right after a Cleaner returns. ID is the Cleaner's index. Cleaners that time out are
+	// still recorded when they finally return, which may be after the Instance is done.
+	CleanerFinished
+
+	// InstanceDone is recorded when the Instance finishes. Err is the error Wait returns.
+	InstanceDone
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case WorkerStarted:
+		return "worker started"
+	case WorkerFinished:
+		return "worker finished"
+	case AbortOrdered:
+		return "abort ordered"
+	case CleanerStarted:
+		return "cleaner started"
+	case CleanerFinished:
+		return "cleaner finished"
+	case InstanceDone:
+		return "instance done"
+	default:
+		return "EventKind(" + strconv.Itoa(int(k)) + ")"
+	}
+}
+
+// Event is a single entry in an Instance's timeline, see Group.SetRecordTimeline.
+type Event struct {
+	Time time.Time
+	Kind EventKind
+
+	// ID is the Worker ID or Cleaner index the event is about, or -1 if it is about the whole Instance.
+	ID int
+
+	// Cause is only set for AbortOrdered events.
+	Cause AbortCause
+
+	// Err is the error involved, if any.
+	Err error
+}
+
+// SetRecordTimeline controls whether Instances record a timeline of everything that happens to them: Workers starting
+// and returning, the abort, Cleaners starting and returning, and the Instance finishing. See Instance.Timeline.
+//
+// This is a debugging aid for working out why a shutdown took as long as it did. Every event takes the Instance's lock
+// and grows a slice, so it is off by default.
+func (wg *Group) SetRecordTimeline(record bool) {
+	wg.opts.recordTimeline = record
+}
+
+// Timeline returns a copy of the events recorded so far, in the order they happened. This may be called while the
+// Instance is running. If the Group did not have SetRecordTimeline turned on this returns nil.
+func (in *Instance) Timeline() []Event {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+
+	if in.timeline == nil {
+		return nil
+	}
+	return append([]Event(nil), in.timeline...)
+}
+
+// record adds an event to the timeline, if it is being recorded.
+func (in *Instance) record(kind EventKind, id int, err error) {
+	if !in.opts.recordTimeline {
+		return
+	}
+
+	in.lock.Lock()
+	defer in.lock.Unlock()
+	in.recordLocked(Event{Kind: kind, ID: id, Err: err})
+}
+
+// recordLocked is record for callers that already hold the lock. The event's time is filled in here.
+func (in *Instance) recordLocked(e Event) {
+	if !in.opts.recordTimeline {
+		return
+	}
+
+	e.Time = time.Now()
+	in.timeline = append(in.timeline, e)
+}
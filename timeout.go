@@ -0,0 +1,107 @@
+/*
+Copyright 2016 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package workergroup
+
+import "context"
+import "errors"
+import "time"
+
+// ErrTimeout is returned by Wait when an Instance started with StartWithTimeout runs out of time.
+var ErrTimeout = errors.New("Instance did not finish within its timeout.")
+
+// StartWithTimeout is like Start, except the Instance is aborted if it is still running after d. When that happens
+// the abort cause is TimedOut and Wait returns ErrTimeout, unless a Worker error arrived first (in which case the
+// Instance was already aborting, and the timeout doesn't change anything). Worker errors received after the timeout
+// replace ErrTimeout as usual, see Instance.Wait.
+//
+// The timeout covers the Workers, Fallbacks, and Finalizers. Once the Cleaners have started it is too late to time
+// out, and the timer is stopped as soon as the Instance is done. The Instance's context has the timeout as its
+// deadline, so ContextWorkers (and Instance.Deadline) can see how long they have left.
+func (wg *Group) StartWithTimeout(data interface{}, d time.Duration) *Instance {
+	if d <= 0 {
+		// Out of time before it even started.
+		d = time.Nanosecond
+	}
+	return wg.startWith(context.Background(), data, wg.cleaners, nil, d, 0)
+}
+
+// IsTimeout reports whether err represents a timeout: ErrTimeout from an Instance started with StartWithTimeout, or
+// context.DeadlineExceeded from one started with StartContext. Like IsAbort, it still works if the error is wrapped.
+func IsTimeout(err error) bool {
+	return errors.Is(err, ErrTimeout) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// RunWithTimeout is like Run, except the Instance has a timeout, see StartWithTimeout.
+func (wg *Group) RunWithTimeout(data interface{}, d time.Duration) error {
+	return wg.StartWithTimeout(data, d).Wait()
+}
+
+// RunWithBudget is like Run, except the whole run, Cleaners included, has to fit in budget.
+//
+// The budget is split in two. The Cleaners are set aside the time they are allowed to take, which is the sum of the
+// timeouts given to AddCleanerTimeout (other Cleaners are assumed to be quick), and the Workers get the rest, as if
+// they had been started with StartWithTimeout. If the Cleaners' timeouts add up to the whole budget or more, the
+// Workers get half of it. When the Workers run out of time they are aborted and Wait returns ErrTimeout as usual.
+//
+// Workers that take a while to return after the abort eat into the Cleaners' share. Whatever is left when the Cleaners
+// start caps each of them in turn, a Cleaner still running when the budget is used up is abandoned just like one that
+// went over its own timeout (it is recorded as a *CleanerTimeoutError, see Instance.CleanupErrors), and any Cleaner
+// after that is abandoned as soon as it starts. The budget can't be kept if a Worker ignores the abort entirely, use
+// SetStragglerGrace if that is a concern.
+func (wg *Group) RunWithBudget(data interface{}, budget time.Duration) error {
+	if budget <= 0 {
+		budget = time.Nanosecond
+	}
+
+	var reserve time.Duration
+	for _, c := range wg.cleaners {
+		reserve += c.timeout
+	}
+	workers := budget - reserve
+	if workers <= 0 {
+		workers = budget / 2
+	}
+	if workers <= 0 {
+		workers = time.Nanosecond
+	}
+	return wg.startWith(context.Background(), data, wg.cleaners, nil, workers, budget).Wait()
+}
+
+// watchTimeout aborts the Instance if it is still running at its deadline. The watching goroutine exits when the
+// Instance finishes.
+func (in *Instance) watchTimeout() {
+	if in.deadline.IsZero() {
+		return
+	}
+
+	go func() {
+		t := time.NewTimer(time.Until(in.deadline))
+		defer t.Stop()
+
+		select {
+		case <-t.C:
+			in.failAbort(TimedOut, ErrTimeout)
+		case <-in.done:
+		}
+	}()
+}
@@ -23,13 +23,23 @@ misrepresented as being the original software.
 // A convenience system for managing linked groups of goroutines.
 package workergroup
 
+import "context"
+import "math/rand"
 import "runtime"
+import "runtime/debug"
+import "runtime/pprof"
+import "strconv"
+import "strings"
 import "errors"
+import "fmt"
+import "sync"
+import "sync/atomic"
+import "time"
 
 // Worker is the type that that a worker function must match.
 //
-// If a Worker returns a non-nil error the Group Instance it belongs will be aborted and the
-// error will be saved to return to the client. If multiple Workers return errors the last error
+// If a Worker returns a non-nil error the Group Instance it belongs will be aborted (see Group.SetErrorThreshold) and
+// the error will be saved to return to the client. If multiple Workers return errors the last error
 // reported to the Group Instance will be the one reported.
 //
 // The passed in "abort" channel will never have a value sent on it, instead it will be closed if
@@ -45,146 +55,2217 @@ type Worker func(abort <-chan bool, data interface{}) error
 // Cleaner is the type that a cleanup function must conform to.
 //
 // Cleanup functions are functions that may be optionally registered to run after all the Workers
-// in a Group Instance return. Cleaners will always be called in the order they were added.
+// in a Group Instance return. Cleaners will always be called in the order they were added (unless
+// Group.SetConcurrentCleaners is used).
 // Generally you would use Cleaners to free/close resources (files, network connections, etc) stored
 // in the "data" value.
 //
 // The "data" argument is the same value passed to the Workers.
 type Cleaner func(data interface{})
 
+// CleanerE is a Cleaner that is also told how the Instance ended. "err" is the error Wait will return (including
+// NonErrorAbort for an explicit abort), or nil if the Instance succeeded.
+type CleanerE func(data interface{}, err error)
+
+// Cancelable may be implemented by a data value to tie its Instance's lifetime to it. If the data value passed to
+// Start implements this interface the Instance will be aborted (exactly as if Abort was called) when the returned
+// channel is closed.
+//
+// context.Context implements this interface, so a Context (or any type that embeds one) may be used directly.
+type Cancelable interface {
+	Done() <-chan struct{}
+}
+
 // NonErrorAbort is returned by Wait if Abort is used to abort the Instance and no other errors are
-// generated by the Workers.
+// generated by the Workers. This can be turned off with Group.SetAbortIsError.
 var NonErrorAbort = errors.New("Instance aborted due to explicit order (not error triggered).")
 
-// Group is a convenience mechanism for launching and controlling multiple goroutines.
-//
-// This is intended for cases where you have a set of goroutines that all work together,
-// and want the ability to abort the whole set cleanly and/or launch copies of the set
-// on demand. Keep in mind that that for relaunchable tasks you can get better performance
-// by designing a purpose built system tuned to your specific requirements. This is simply
-// a convenience with "good enough" performance, not a perfect generic solution.
-//
-// A Group does not store any information specific to an individual run, it is actually
-// perfectly safe to modify a Group after calling Start or Run (just don't expect your
-// additions to affect running Instances). In a similar vein so long as your Workers and
-// Cleaners make proper use of their data values and won't clobber each other or share
-// resources inappropriately you can run multiple copies of a Group in parallel.
-type Group struct {
-	counts   []int
-	workers  []Worker
-	cleaners []Cleaner
-}
+// AbortCause describes why an Instance was aborted, see Instance.AbortCause.
+type AbortCause int
+
+const (
+	// NotAborted means the Instance has not been aborted.
+	NotAborted AbortCause = iota
+
+	// ExplicitAbort means the Instance was aborted by a call to Abort (or something that calls it for you, like a
+	// canceled data value or an external abort channel).
+	ExplicitAbort
+
+	// WorkerError means a Worker returned an error.
+	WorkerError
+
+	// HealthCheckFailed means the Group's health check returned an error, see Group.SetHealthCheck.
+	HealthCheckFailed
+
+	// ContextCanceled means the parent context passed to StartContext was canceled (or reached its deadline).
+	ContextCanceled
+
+	// TimedOut means the Instance ran for longer than the timeout given to StartWithTimeout.
+	TimedOut
+
+	// RetryBudgetExhausted means the Workers added with AddRetry used up the Group's total retry budget, see
+	// Group.SetTotalRetryBudget.
+	RetryBudgetExhausted
+)
+
+func (c AbortCause) String() string {
+	switch c {
+	case NotAborted:
+		return "not aborted"
+	case ExplicitAbort:
+		return "explicit abort"
+	case WorkerError:
+		return "worker error"
+	case HealthCheckFailed:
+		return "health check failed"
+	case ContextCanceled:
+		return "context canceled"
+	case TimedOut:
+		return "timed out"
+	case RetryBudgetExhausted:
+		return "retry budget exhausted"
+	default:
+		return "AbortCause(" + strconv.Itoa(int(c)) + ")"
+	}
+}
+
+// IsAbort reports whether err represents a clean explicit abort. Use this rather than comparing against NonErrorAbort
+// directly, as it will still work if the error is wrapped.
+func IsAbort(err error) bool {
+	return errors.Is(err, NonErrorAbort)
+}
+
+// Group is a convenience mechanism for launching and controlling multiple goroutines.
+//
+// This is intended for cases where you have a set of goroutines that all work together,
+// and want the ability to abort the whole set cleanly and/or launch copies of the set
+// on demand. Keep in mind that that for relaunchable tasks you can get better performance
+// by designing a purpose built system tuned to your specific requirements. This is simply
+// a convenience with "good enough" performance, not a perfect generic solution.
+//
+// A Group does not store any information specific to an individual run, it is actually
+// perfectly safe to modify a Group after calling Start or Run (just don't expect your
+// additions to affect running Instances). In a similar vein so long as your Workers and
+// Cleaners make proper use of their data values and won't clobber each other or share
+// resources inappropriately you can run multiple copies of a Group in parallel.
+//
+// Start (and Run) only read from the Group, so it is safe to call them from many goroutines at once. It is not safe
+// to modify the Group (Add, AddCleaner, the various Set methods) while another goroutine is starting it.
+type Group struct {
+	counts   []int
+	workers  []runner
+	cleaners []cleaner
+
+	fallbacks  []Fallback
+	finalizers []Worker
+
+	nodes []node
+
+	opts options
+}
+
+// runner is the internal form of a Worker. The extra arguments allow Worker variants (such as ControlWorker) to get
+// at state that belongs to the Instance or to a specific copy. A nil runner means a nil Worker was added.
+type runner func(in *Instance, id, copy int, data interface{}) error
+
+// cleaner is a registered Cleaner along with the outcomes it should run for.
+type cleaner struct {
+	fn Cleaner
+
+	// withErr is set instead of fn for Cleaners added with AddCleanerE.
+	withErr CleanerE
+
+	// withResults is set instead of fn for Cleaners added with AddResultCleaner.
+	withResults ResultCleaner
+
+	// withIterator is set instead of fn for Cleaners added with AddIteratorCleaner.
+	withIterator IteratorCleaner
+
+	onSuccess bool
+	onFailure bool
+
+	// timeout is how long the Cleaner may run before it is abandoned, zero for no limit.
+	timeout time.Duration
+}
+
+// options holds the Group settings that affect how an Instance runs. It is copied into each Instance when it is
+// started, so changing a setting never affects Instances that are already running.
+type options struct {
+	// abortNotError is inverted so that the zero value gives the default behavior.
+	abortNotError bool
+
+	// newBuffer is used as the New function for each Instance's buffer pool.
+	newBuffer func() interface{}
+
+	failFast bool
+
+	// spawner is used to launch Worker goroutines, if nil the go statement is used directly.
+	spawner func(fn func())
+
+	pprofLabels bool
+
+	alwaysClean bool
+	cleanIfRan  bool
+
+	onWorkerStart  func(id int)
+	onWorkerFinish func(id int, elapsed time.Duration, err error)
+
+	errorThreshold int
+
+	abortIf func(err error) bool
+
+	goroutineIDs bool
+
+	onThreshold func(count int)
+
+	concurrentClean bool
+
+	wrapErrors bool
+
+	minRunDuration time.Duration
+
+	// randSeed is only used if seeded is set, otherwise each Instance seeds its Rand from the clock.
+	randSeed int64
+	seeded   bool
+
+	runErrors bool
+
+	stragglerGrace time.Duration
+
+	errorPolicy ErrorPolicy
+
+	onNeverWaited func(report RunReport)
+
+	recordTimeline bool
+
+	healthInterval time.Duration
+	healthCheck    func(data interface{}) error
+
+	contextErrorsFatal bool
+
+	joinErrors bool
+
+	recoverPanics bool
+
+	maxConcurrent int
+	scheduler     func(waiting []int) int
+
+	resultSink      func(result interface{})
+	resultValidator func(result interface{}) error
+	resultBuffer    int
+	resultPolicy    ResultBufferPolicy
+	spillThreshold  int
+	spillEncoder    Encoder
+
+	// retryBudget is the total number of retries an Instance's Workers may make, see SetTotalRetryBudget.
+	retryBudget int
+
+	// resultDefault is used by CollectorWorkers that take longer than resultDeadline, see SetResultDefault.
+	resultDeadline time.Duration
+	resultDefault  interface{}
+}
+
+// Add the given Worker to the Group.
+//
+// When the Group launches an Instance it will contain "count" copies of the given Worker.
+// If "count" is <= 0 then runtime.NumCPU copies of this worker will be launched.
+func (wg *Group) Add(count int, worker Worker) {
+	var r runner
+	if worker != nil {
+		r = func(in *Instance, id, copy int, data interface{}) error {
+			return worker(in.abort, data)
+		}
+	}
+	wg.add(count, r)
+}
+
+// add is the common part of Add and its variants.
+func (wg *Group) add(count int, r runner) {
+	if count <= 0 {
+		count = runtime.NumCPU()
+	}
+
+	wg.workers = append(wg.workers, r)
+	wg.counts = append(wg.counts, count)
+}
+
+// AddLocked is like Add, except each copy of the Worker is locked to its own OS thread (see runtime.LockOSThread) for
+// as long as it runs. This is for Workers that call into libraries that require all calls to come from the same thread,
+// such as OpenGL or some cgo based drivers. The thread is unlocked when the Worker returns, even if it panics.
+//
+// Locking a thread is fairly expensive and prevents the runtime from scheduling anything else on it, so only use this
+// for Workers that actually need it.
+func (wg *Group) AddLocked(count int, worker Worker) {
+	if worker == nil {
+		// Let Validate report it.
+		wg.Add(count, nil)
+		return
+	}
+
+	wg.Add(count, func(abort <-chan bool, data interface{}) error {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+
+		return worker(abort, data)
+	})
+}
+
+// AddWithTransform is like Add, except each copy of the Worker is passed transform(data, copy) instead of the data
+// value passed to Start, where copy is which copy this is (from 0 to count-1). This makes it easy to give each copy its
+// own view of shared data, for example a shard of a slice, without the Worker needing to know its copy number.
+//
+// The transform is called once per copy, in the copy's own goroutine, right before the Worker. Cleaners and other
+// Workers still get the original data value. A nil transform is the same as calling Add.
+func (wg *Group) AddWithTransform(count int, transform func(data interface{}, copy int) interface{}, worker Worker) {
+	if worker == nil || transform == nil {
+		// A nil Worker is left for Validate to report.
+		wg.Add(count, worker)
+		return
+	}
+
+	wg.add(count, func(in *Instance, id, copy int, data interface{}) error {
+		return worker(in.abort, transform(data, copy))
+	})
+}
+
+// IndexedWorker is a Worker that is also told which copy it is, see Group.AddIndexed.
+type IndexedWorker func(abort <-chan bool, data interface{}, copy int) error
+
+// AddIndexed is like Add, except each copy of the Worker is passed its copy number, from 0 to count-1 (numbered
+// separately for each call to AddIndexed). This lets copies split up a shared input between themselves, or pick their
+// own slot in a slice, without any coordination. If "count" is <= 0 the copies are numbered up to runtime.NumCPU-1.
+func (wg *Group) AddIndexed(count int, worker IndexedWorker) {
+	if worker == nil {
+		// Let Validate report it.
+		wg.add(count, nil)
+		return
+	}
+
+	wg.add(count, func(in *Instance, id, copy int, data interface{}) error {
+		return worker(in.abort, data, copy)
+	})
+}
+
+// InstanceWorker is a Worker that is also given the Instance it is running in, see Group.AddWithInstance.
+type InstanceWorker func(abort <-chan bool, data interface{}, in *Instance) error
+
+// AddWithInstance is like Add, except each copy of the Worker is passed its Instance. This is how a Worker gets at the
+// Instance's helpers, such as GetBuffer and PutBuffer or Rand, without the Instance having to be smuggled in through
+// the data value (which isn't possible, as the data value must exist before Start returns the Instance).
+//
+// The Worker should stick to the helpers, waiting on its own Instance (Wait and friends) will never return.
+func (wg *Group) AddWithInstance(count int, worker InstanceWorker) {
+	if worker == nil {
+		// Let Validate report it.
+		wg.add(count, nil)
+		return
+	}
+
+	wg.add(count, func(in *Instance, id, copy int, data interface{}) error {
+		return worker(in.abort, data, in)
+	})
+}
+
+// AddCritical is like Add, except the Worker is never told to abort. Instead of the Instance's abort channel it is
+// passed a channel that is never closed, so it always runs to completion. Use this for short operations that must not
+// be interrupted partway through. An error returned by a critical Worker will still abort the rest of the Instance.
+//
+// Keep in mind that the Instance can't finish until every critical Worker returns, so a critical Worker that hangs
+// will block shutdown forever!
+func (wg *Group) AddCritical(count int, worker Worker) {
+	if worker == nil {
+		// Let Validate report it.
+		wg.Add(count, nil)
+		return
+	}
+
+	never := make(chan bool)
+	wg.Add(count, func(abort <-chan bool, data interface{}) error {
+		return worker(never, data)
+	})
+}
+
+// AddStaggered is like Add, except the copies of the Worker don't all start at once. The first copy starts right away,
+// and each copy after that starts "delay" after the one before it. This avoids things like every Worker dialing the
+// same server at the same moment.
+//
+// If the Instance is aborted before a copy starts that copy is skipped, it counts as having returned nil.
+func (wg *Group) AddStaggered(count int, delay time.Duration, worker Worker) {
+	if worker == nil {
+		// Let Validate report it.
+		wg.add(count, nil)
+		return
+	}
+
+	wg.add(count, func(in *Instance, id, copy int, data interface{}) error {
+		if copy > 0 && delay > 0 {
+			start := in.waitToStart(id, func() bool {
+				t := time.NewTimer(time.Duration(copy) * delay)
+				defer t.Stop()
+				select {
+				case <-in.abort:
+					return false
+				case <-t.C:
+					return true
+				}
+			})
+			if !start {
+				return nil
+			}
+		}
+		return worker(in.abort, data)
+	})
+}
+
+// AddRetry is like Add, except a copy of the Worker that returns an error is run again, up to "retries" more times,
+// before the error is reported to the Instance. Only the error from the last attempt is reported, the earlier ones are
+// discarded. This is meant for Workers with transient failures, such as a dropped network connection.
+//
+// Once the Instance is aborting there are no more retries, the last error is reported as is. "retries" bounds each
+// copy on its own, to bound all of them together see SetTotalRetryBudget.
+func (wg *Group) AddRetry(count int, retries int, worker Worker) {
+	if worker == nil {
+		// Let Validate report it.
+		wg.add(count, nil)
+		return
+	}
+
+	wg.add(count, func(in *Instance, id, copy int, data interface{}) error {
+		err := worker(in.abort, data)
+		for i := 0; err != nil && i < retries; i++ {
+			select {
+			case <-in.abort:
+				return err
+			default:
+			}
+			if !in.takeRetry() {
+				in.failAbort(RetryBudgetExhausted, ErrRetryBudget)
+				return &RetryBudgetError{Budget: in.opts.retryBudget, Err: err}
+			}
+			err = worker(in.abort, data)
+		}
+		return err
+	})
+}
+
+// ErrRetryBudget is wrapped by the *RetryBudgetError a Worker reports when the total retry budget runs out, see
+// SetTotalRetryBudget.
+var ErrRetryBudget = errors.New("Instance used up its total retry budget.")
+
+// RetryBudgetError is reported in place of the error from a Worker added with AddRetry that would have been retried,
+// but the Instance had no retries left (see SetTotalRetryBudget). errors.Is matches both ErrRetryBudget and the
+// Worker's own error.
+type RetryBudgetError struct {
+	// Budget is the total number of retries the Instance was allowed.
+	Budget int
+
+	// Err is the error from the Worker's last attempt.
+	Err error
+}
+
+func (err *RetryBudgetError) Error() string {
+	return fmt.Sprintf("Instance used up its total retry budget of %d (%v)", err.Budget, err.Err)
+}
+
+// Unwrap returns ErrRetryBudget and Err.
+func (err *RetryBudgetError) Unwrap() []error {
+	return []error{ErrRetryBudget, err.Err}
+}
+
+// SetTotalRetryBudget caps the number of retries (see AddRetry) all of an Instance's Workers may make between them. A
+// Worker that would be retried once the budget is used up reports a *RetryBudgetError instead, and the Instance is
+// aborted with the cause RetryBudgetExhausted whatever the error handling settings say (AbortIf, SetErrorPolicy, and so
+// on). Wait then returns ErrRetryBudget, which Worker errors received afterwards replace as usual (much like
+// ErrTimeout, see StartWithTimeout). This catches many Workers each failing a little, which the per-Worker limit on its
+// own would let thrash for a long time. The retries made are reported in RunReport.Retries. An n <= 0 (the default)
+// means no limit.
+func (wg *Group) SetTotalRetryBudget(n int) {
+	wg.opts.retryBudget = n
+}
+
+// takeRetry uses up one retry from the total retry budget, returning false if there are none left.
+func (in *Instance) takeRetry() bool {
+	for {
+		n := in.retries.Load()
+		if in.opts.retryBudget > 0 && n >= int64(in.opts.retryBudget) {
+			return false
+		}
+		if in.retries.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+// Fallback is a last resort Worker, see Group.AddFallback. It is passed the errors returned by the Workers (in the
+// order they were received) so it knows what went wrong.
+type Fallback func(abort <-chan bool, data interface{}, errs []error) error
+
+// AddFallback adds a Fallback to the Group. Fallbacks only run if every one of an Instance's Workers returned an error.
+// They run one at a time, in the order they were added, after all the Workers have returned but before the Cleaners.
+// As soon as one succeeds (returns nil) the rest are skipped and the Instance is considered to have recovered: Wait
+// will return nil (the original errors are still available from Instance.Errors). If every Fallback fails, Wait
+// returns the error from the last one.
+//
+// By the time a Fallback runs the Instance has already been aborted (that is what the first Worker error does), so
+// Fallbacks are given an abort channel that is never closed. Like a critical Worker (see AddCritical) a Fallback that
+// hangs will block the Instance forever.
+func (wg *Group) AddFallback(fallback Fallback) {
+	wg.fallbacks = append(wg.fallbacks, fallback)
+}
+
+// AddFinalizer adds a Worker that runs once, after every normal Worker (and any Fallbacks) have returned, but before
+// the Cleaners. This is the place for work like assembling the Workers' partial results into a final artifact, which
+// unlike a Cleaner may fail: a non-nil return is recorded like any other Worker error (see Instance.Errors) and
+// becomes the error Wait returns.
+//
+// Finalizers run one at a time, in the order they were added, with the Instance's normal abort channel. If the
+// Instance was aborted while the Workers were running the channel will already be closed when the Finalizer starts,
+// so it can decide for itself whether there is anything worth finishing. Finalizers do not appear in the RunReport,
+// and are skipped for Instances with no Workers.
+func (wg *Group) AddFinalizer(worker Worker) {
+	wg.finalizers = append(wg.finalizers, worker)
+}
+
+// Combine creates a new Group containing all the Workers, Cleaners, and Finalizers from the given Groups, so they can
+// be run and aborted as a unit. Workers keep their counts, and Cleaners run in Group order, then in the order they were
+// added to each Group. Registration indexes in the new Group follow the same order.
+//
+// Only Workers, Cleaners, Fallbacks, and Finalizers are copied, the new Group starts with the default settings. Nil
+// Groups are skipped.
+func Combine(groups ...*Group) *Group {
+	c := new(Group)
+	for _, g := range groups {
+		if g == nil {
+			continue
+		}
+
+		for _, n := range g.nodes {
+			n.index += len(c.workers)
+			c.nodes = append(c.nodes, n)
+		}
+		c.counts = append(c.counts, g.counts...)
+		c.workers = append(c.workers, g.workers...)
+		c.cleaners = append(c.cleaners, g.cleaners...)
+		c.fallbacks = append(c.fallbacks, g.fallbacks...)
+		c.finalizers = append(c.finalizers, g.finalizers...)
+	}
+	return c
+}
+
+// Clone returns a copy of the Group with the same Workers, Cleaners, Fallbacks, Finalizers, and settings, so the copy
+// behaves exactly like the original. Adding things to or changing settings on the copy does not affect the original or
+// vice versa, but the functions themselves (Workers, hooks, and so on) are shared, so any state they close over is
+// shared as well.
+//
+// Unlike Combine, Clone keeps every setting. Any new option must live in the options struct so it is copied here.
+func (wg *Group) Clone() *Group {
+	return &Group{
+		counts:     append([]int(nil), wg.counts...),
+		workers:    append([]runner(nil), wg.workers...),
+		cleaners:   append([]cleaner(nil), wg.cleaners...),
+		fallbacks:  append([]Fallback(nil), wg.fallbacks...),
+		finalizers: append([]Worker(nil), wg.finalizers...),
+		nodes:      append([]node(nil), wg.nodes...),
+		opts:       wg.opts,
+	}
+}
+
+// RunPlan describes what a Group would launch if it was started, see Group.Plan.
+type RunPlan struct {
+	// Counts holds the number of copies that will be launched for each registration, in the order they were added.
+	Counts []int
+
+	// Total is the total number of Worker goroutines that will be launched.
+	Total int
+}
+
+// Plan returns the number of Workers the Group would launch if it was started right now, without launching anything.
+// Counts of zero or less are already resolved to runtime.NumCPU by Add, so these are the actual numbers.
+func (wg *Group) Plan() RunPlan {
+	plan := RunPlan{Counts: make([]int, len(wg.counts))}
+	copy(plan.Counts, wg.counts)
+	for _, c := range wg.counts {
+		plan.Total += c
+	}
+	return plan
+}
+
+// ErrNoWorkers is reported by Validate if a Group has no Workers.
+var ErrNoWorkers = errors.New("Group has no Workers.")
+
+// ValidationError is returned by Validate, it lists every problem found with the Group.
+type ValidationError struct {
+	Problems []error
+}
+
+func (err *ValidationError) Error() string {
+	if len(err.Problems) == 1 {
+		return err.Problems[0].Error()
+	}
+
+	msg := fmt.Sprintf("Group has %d problems:", len(err.Problems))
+	for _, p := range err.Problems {
+		msg += "\n\t" + p.Error()
+	}
+	return msg
+}
+
+// Is allows errors.Is to match any of the individual problems, so errors.Is(err, ErrNoWorkers) works as expected.
+func (err *ValidationError) Is(target error) bool {
+	for _, p := range err.Problems {
+		if errors.Is(p, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the Group for problems that would otherwise only show up once it is started, such as nil Workers
+// (which would panic inside the Worker's goroutine) or a Group with no Workers at all.
+//
+// If any problems are found the returned error will be a *ValidationError listing all of them, not just the first.
+func (wg *Group) Validate() error {
+	problems := []error{}
+
+	if len(wg.workers) == 0 {
+		problems = append(problems, ErrNoWorkers)
+	}
+
+	for i, w := range wg.workers {
+		if w == nil {
+			problems = append(problems, fmt.Errorf("Worker %d is nil.", i))
+		}
+		if wg.counts[i] <= 0 {
+			problems = append(problems, fmt.Errorf("Worker %d has a count of %d.", i, wg.counts[i]))
+		}
+	}
+
+	for i, c := range wg.cleaners {
+		if c.fn == nil && c.withErr == nil && c.withResults == nil && c.withIterator == nil {
+			problems = append(problems, fmt.Errorf("Cleaner %d is nil.", i))
+		}
+	}
+
+	for i, f := range wg.finalizers {
+		if f == nil {
+			problems = append(problems, fmt.Errorf("Finalizer %d is nil.", i))
+		}
+	}
+
+	problems = append(problems, wg.graphProblems()...)
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return &ValidationError{problems}
+}
+
+// AddCleaner adds a Cleaner to the Group.
+func (wg *Group) AddCleaner(clean Cleaner) {
+	wg.cleaners = append(wg.cleaners, cleaner{fn: clean, onSuccess: true, onFailure: true})
+}
+
+// AddCleanerE adds a Cleaner that receives the Instance's final error, for things like committing a transaction on
+// success and rolling it back on failure with a single Cleaner.
+func (wg *Group) AddCleanerE(clean CleanerE) {
+	wg.cleaners = append(wg.cleaners, cleaner{withErr: clean, onSuccess: true, onFailure: true})
+}
+
+// CleanerTimeoutError is recorded in Instance.CleanupErrors when a Cleaner added with AddCleanerTimeout takes too long.
+type CleanerTimeoutError struct {
+	// Index is the Cleaner's position in the Group's list of Cleaners.
+	Index int
+
+	Timeout time.Duration
+}
+
+func (err *CleanerTimeoutError) Error() string {
+	return fmt.Sprintf("Cleaner %d did not finish within %v and was abandoned.", err.Index, err.Timeout)
+}
+
+// CleanerPanicError is recorded in Instance.CleanupErrors when a Cleaner panics. A panicking Cleaner never stops the
+// rest of the Cleaners from running, or the Instance from finishing.
+type CleanerPanicError struct {
+	// Index is the Cleaner's position in the Group's list of Cleaners.
+	Index int
+
+	// Value is the value passed to panic.
+	Value interface{}
+
+	// Stack is the stack trace of the panicking goroutine, as returned by runtime/debug.Stack.
+	Stack []byte
+}
+
+func (err *CleanerPanicError) Error() string {
+	return fmt.Sprintf("Cleaner %d panicked: %v\n\n%s", err.Index, err.Value, err.Stack)
+}
+
+// Unwrap returns the panic value if it is an error, so errors.Is and errors.As can see through a panic(err).
+func (err *CleanerPanicError) Unwrap() error {
+	if e, ok := err.Value.(error); ok {
+		return e
+	}
+	return nil
+}
+
+// AddCleanerTimeout adds a Cleaner that may only run for the given amount of time. The Cleaner is run in its own
+// goroutine, if it hasn't returned after "timeout" the Instance stops waiting for it, records a *CleanerTimeoutError
+// (see Instance.CleanupErrors), and moves on to the next Cleaner.
+//
+// An abandoned Cleaner is not stopped (there is no way to do that), it just keeps running in the background. If it is
+// truly stuck its goroutine will leak! Later Cleaners may also run at the same time as an abandoned one, so be careful
+// about shared state.
+func (wg *Group) AddCleanerTimeout(timeout time.Duration, clean Cleaner) {
+	wg.cleaners = append(wg.cleaners, cleaner{fn: clean, onSuccess: true, onFailure: true, timeout: timeout})
+}
+
+// AddSuccessCleaner adds a Cleaner that only runs if the Instance succeeded, that is if Wait will return nil. This is
+// useful for things like committing a transaction.
+//
+// Conditional Cleaners are kept in the same list as the others, they just get skipped if the outcome doesn't match.
+func (wg *Group) AddSuccessCleaner(clean Cleaner) {
+	wg.cleaners = append(wg.cleaners, cleaner{fn: clean, onSuccess: true})
+}
+
+// AddFailureCleaner adds a Cleaner that only runs if the Instance failed, that is if Wait will return an error
+// (including NonErrorAbort). This is useful for things like rolling back a transaction.
+func (wg *Group) AddFailureCleaner(clean Cleaner) {
+	wg.cleaners = append(wg.cleaners, cleaner{fn: clean, onFailure: true})
+}
+
+// SetAbortIsError controls whether an explicit abort is treated as an error.
+//
+// By default (true) Wait will return NonErrorAbort if an Instance is aborted and no Worker returned an error. If
+// this is set to false Wait will return nil instead, treating an explicit abort as a normal, successful end.
+func (wg *Group) SetAbortIsError(isErr bool) {
+	wg.opts.abortNotError = !isErr
+}
+
+// SetBufferPool gives each Instance a pool of reusable scratch objects, created with "new" as required. Workers can
+// borrow objects with Instance.GetBuffer and return them with Instance.PutBuffer (use AddWithInstance to give a Worker
+// its Instance).
+//
+// The pool belongs to the Instance, so objects are never shared between runs and are freed along with the Instance.
+func (wg *Group) SetBufferPool(new func() interface{}) {
+	wg.opts.newBuffer = new
+}
+
+// SetFailFast controls whether Wait returns as soon as the first Worker error is recorded.
+//
+// Normally Wait does not return until every Worker has noticed the abort and returned, and all the Cleaners have run.
+// In fail fast mode Wait will return the first error immediately, while the remaining Workers drain in the background.
+// Cleaners are still deferred until every Worker has actually returned. Use Instance.WaitDrain if you need to wait for
+// the full drain later.
+func (wg *Group) SetFailFast(failFast bool) {
+	wg.opts.failFast = failFast
+}
+
+// SetSpawner overrides how the Instance launches its Worker goroutines. Instead of "go fn()" Start will call
+// "spawn(fn)" once per Worker copy. This allows Workers to be routed through a goroutine pool, wrapped with labels or
+// tracing, or anything else you need.
+//
+// The spawner must run fn exactly once. It may run fn in the calling goroutine, but that will block Start until that
+// Worker returns. Pass nil to go back to plain goroutines.
+func (wg *Group) SetSpawner(spawn func(fn func())) {
+	wg.opts.spawner = spawn
+}
+
+// SetPprofLabels controls whether Worker goroutines are tagged with pprof labels. When turned on each Worker runs
+// with the label "workergroup.worker" set to its registration index and "workergroup.id" set to its ID (its index in
+// RunReport.Workers), so CPU and goroutine profiles can attribute time to specific Workers.
+//
+// This is off by default, as setting the labels has a small cost for every Worker launched.
+func (wg *Group) SetPprofLabels(labels bool) {
+	wg.opts.pprofLabels = labels
+}
+
+// SetConcurrentCleaners controls whether an Instance's Cleaners run one after the other in the order they were added
+// (the default), or all at once. Running them concurrently can speed up shutdown a lot when the Cleaners are
+// independent and spend their time waiting on I/O (closing network connections for example). The Instance still waits
+// for every Cleaner to return before it is done.
+//
+// Concurrent Cleaners must not depend on each other, and must not share unsynchronized state!
+func (wg *Group) SetConcurrentCleaners(concurrent bool) {
+	wg.opts.concurrentClean = concurrent
+}
+
+// SetMinRunDuration sets the shortest time a failed run may take before it is considered a crash loop. An Instance
+// that fails sooner than this is flagged in its report (see RunReport.TooShort), and scheduled runs (see RunEvery)
+// will wait for d after such a run finishes before starting another one. This stops a Group that fails instantly from
+// being restarted over and over as fast as the schedule allows.
+//
+// Zero (the default) turns this off.
+func (wg *Group) SetMinRunDuration(d time.Duration) {
+	wg.opts.minRunDuration = d
+}
+
+// ErrAbandoned is reported for Workers that were still running when the straggler grace period ran out, see
+// Group.SetStragglerGrace.
+var ErrAbandoned = errors.New("Worker did not return within the straggler grace period and was abandoned.")
+
+// SetStragglerGrace sets how long an aborting Instance will wait for its Workers to return. Once the Instance has been
+// aborting for longer than d it stops waiting: any Workers that have not returned are marked as abandoned in the
+// report (see WorkerReport.Abandoned, their Err is ErrAbandoned), and the Instance carries on with its Fallbacks,
+// Finalizers, and Cleaners and finishes as normal. ErrAbandoned is not a Worker error, it never becomes the error Wait
+// returns.
+//
+// This is for Workers you cannot make respond to an abort, such as third party code, so one of them getting wedged
+// doesn't block Wait forever. The price is a goroutine leak: the abandoned Worker keeps running in the background,
+// and it may still be using the data value after the Cleaners have run. Make sure that is safe before you use this,
+// and check the report for abandoned Workers (or use Instance.WaitOrLeak) so the leak doesn't go unnoticed.
+//
+// Zero (the default) waits forever.
+func (wg *Group) SetStragglerGrace(d time.Duration) {
+	wg.opts.stragglerGrace = d
+}
+
+// ErrWorkersLeaked is wrapped by the *LeakError returned from Instance.WaitOrLeak.
+var ErrWorkersLeaked = errors.New("Workers did not return after the abort and were leaked.")
+
+// LeakError is returned by Instance.WaitOrLeak when Workers were abandoned because of SetStragglerGrace. errors.Is
+// matches both ErrWorkersLeaked and the error the Instance would otherwise have returned.
+type LeakError struct {
+	// IDs lists the abandoned Workers (their indexes in RunReport.Workers), lowest first.
+	IDs []int
+
+	// Err is the error WaitDrain returns, usually the error that caused the abort.
+	Err error
+}
+
+func (err *LeakError) Error() string {
+	return workerListError("leaked after the abort", err.IDs, err.Err)
+}
+
+// Unwrap returns ErrWorkersLeaked and Err.
+func (err *LeakError) Unwrap() []error {
+	return unwrapWith(ErrWorkersLeaked, err.Err)
+}
+
+// workerListError formats the message for an error about a list of Workers (see LeakError and DrainTimeoutError):
+// how many there are, what happened to them, their IDs, and the underlying error if there is one.
+func workerListError(what string, ids []int, err error) string {
+	list := make([]string, len(ids))
+	for i, id := range ids {
+		list[i] = strconv.Itoa(id)
+	}
+	msg := fmt.Sprintf("%d Worker(s) %s: %s", len(list), what, strings.Join(list, ", "))
+	if err != nil {
+		msg += " (" + err.Error() + ")"
+	}
+	return msg
+}
+
+// unwrapWith returns sentinel followed by err, leaving err out if it is nil.
+func unwrapWith(sentinel, err error) []error {
+	if err == nil {
+		return []error{sentinel}
+	}
+	return []error{sentinel, err}
+}
+
+// WaitOrLeak is WaitDrain for an Instance with a straggler grace period (see Group.SetStragglerGrace): if any Workers
+// ignored the abort and had to be abandoned it returns a *LeakError listing them, rather than letting the leak go
+// unnoticed. Otherwise it returns the same error as WaitDrain.
+//
+// The leaked goroutines are still running, there is no way to stop them. Without a grace period this blocks until
+// every Worker returns, just like WaitDrain.
+func (in *Instance) WaitOrLeak() error {
+	err := in.WaitDrain()
+
+	var ids []int
+	for id, w := range in.report.Workers {
+		if w.Abandoned {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return err
+	}
+	return &LeakError{IDs: ids, Err: err}
+}
+
+// OnNeverWaited registers a function to be called when an Instance of the Group is garbage collected without its
+// result ever having been asked for (with Wait, WaitDrain, Report, OnDone, or anything built on them). It is passed the
+// Instance's report so you can log which run was dropped, and what its Workers returned.
+//
+// This is meant as a development aid for finding places that Start an Instance and forget about it. It relies on
+// runtime.SetFinalizer, so it may run long after the Instance is dropped, or not at all if the program exits first.
+// The function is called from the runtime's finalizer goroutine, so it should be quick and must be safe for
+// concurrent use. Pass nil to remove the hook.
+func (wg *Group) OnNeverWaited(f func(report RunReport)) {
+	wg.opts.onNeverWaited = f
+}
+
+// PanicError is the error recorded for a Worker that panicked, when the Group has SetRecoverPanics turned on.
+type PanicError struct {
+	// Value is the value passed to panic.
+	Value interface{}
+
+	// Stack is the stack trace of the panicking goroutine, as returned by runtime/debug.Stack.
+	Stack []byte
+}
+
+func (err *PanicError) Error() string {
+	return fmt.Sprintf("Worker panicked: %v\n\n%s", err.Value, err.Stack)
+}
+
+// Unwrap returns the panic value if it is an error, so errors.Is and errors.As can see through a panic(err).
+func (err *PanicError) Unwrap() error {
+	if e, ok := err.Value.(error); ok {
+		return e
+	}
+	return nil
+}
+
+// SetRecoverPanics controls whether panics in Workers are recovered. When this is on a Worker that panics is treated
+// exactly as if it had returned a *PanicError: the Instance aborts (subject to the error policy), the other Workers
+// are waited for as usual, the Cleaners run, and Wait returns the error.
+//
+// A recovered panic only affects the Instance it happened in. Instances never share mutable state with each other or
+// with their Group (each one takes a copy of the Group's settings when it starts), so other Instances of the same Group
+// carry on unaffected. Any state the Workers share through the data value or closures is of course up to you.
+//
+// Only Workers are covered, a panic in a Fallback, Finalizer, or hook still crashes the program. Cleaners are a
+// separate case, their panics are always recovered (see CleanerPanicError). This is off by default, since a panic
+// usually means the program is in a state it can't safely continue from.
+func (wg *Group) SetRecoverPanics(enabled bool) {
+	wg.opts.recoverPanics = enabled
+}
+
+// SetMaxConcurrent limits how many Workers of an Instance may run at the same time, for Workers that each need a scarce
+// resource such as a database connection. Every Worker still gets its own goroutine right away, but only n of them
+// call their Worker at once, the rest queue up and start as running ones return (first come, first served, unless
+// there is a scheduler, see SetScheduler). Workers added with Instance.Add share the same limit.
+//
+// A queued Worker that sees an abort before its turn comes is skipped, it counts as having returned nil. A queued
+// Worker has not started as far as WaitStarted is concerned until it runs or is skipped. AddNode Workers waiting on
+// their dependencies and AddStaggered Workers waiting out their delay don't hold a slot while they wait.
+//
+// Zero (the default) means no limit.
+func (wg *Group) SetMaxConcurrent(n int) {
+	wg.opts.maxConcurrent = n
+}
+
+// SetJoinErrors controls whether Wait returns every Worker error rather than just the last one. When this is on and
+// more than one Worker returned an error, the error Wait would have returned is replaced by errors.Join of all of them
+// in the order they were received, including any that were tolerated by an error policy. errors.Is and errors.As see
+// through the joined error as usual. If the Instance succeeded, or failed for some reason other than a Worker error
+// (such as a health check), the error is left alone.
+//
+// In fail fast mode Wait still returns the first error, since it returns before the others are received. Off by
+// default.
+func (wg *Group) SetJoinErrors(join bool) {
+	wg.opts.joinErrors = join
+}
+
+// SetAlwaysClean controls whether Cleaners run for Instances that have no Workers. By default Cleaners are skipped
+// when a Group with no Workers is started, as there is nothing to clean up. Set this if your Cleaners manage state that
+// should be torn down at the end of every Instance, even if the Group ends up empty (for example when it is built
+// dynamically). See SetCleanOnlyIfStarted for the opposite.
+func (wg *Group) SetAlwaysClean(always bool) {
+	wg.opts.alwaysClean = always
+}
+
+// SetCleanOnlyIfStarted is the opposite of SetAlwaysClean: when it is on the Cleaners are skipped unless at least one
+// Worker actually started. This is for Cleaners that tear down something the Workers set up, in Instances that may be
+// aborted before any Worker gets going (for example while they are all queued by SetMaxConcurrent, waiting on AddNode
+// dependencies, or waiting out an AddStaggered delay). A Worker counts as started once your function is called, so
+// unlike for WaitStarted and the WorkerStarted event, a node waiting on its dependencies or a staggered copy waiting
+// out its delay has not started yet.
+//
+// If both this and SetAlwaysClean are on, SetAlwaysClean wins.
+func (wg *Group) SetCleanOnlyIfStarted(only bool) {
+	wg.opts.cleanIfRan = only
+}
+
+// OnWorkerStart registers a function to be called from each Worker's goroutine just before the Worker itself is
+// called. The function is passed the Worker's ID (its index in RunReport.Workers). Comparing the time this is called
+// to the time Start was called gives you the scheduling latency for each Worker.
+//
+// The ID is not the registration index (which call to Add the Worker came from). IDs are handed out in registration
+// order, each registration getting a run of IDs as long as its count, so the index can be worked out from the counts
+// while the Instance is running. Once it is done RunReport.Workers[id].Index has it, for Workers added with
+// Instance.Add too.
+//
+// The function will be called from many goroutines at once, so it must be safe for concurrent use. Pass nil to remove
+// the hook.
+func (wg *Group) OnWorkerStart(f func(id int)) {
+	wg.opts.onWorkerStart = f
+}
+
+// OnWorkerFinish registers a function to be called each time a Worker returns, with the Worker's ID (as for
+// OnWorkerStart, which explains how to map it to a registration index), the time it spent running, and the error it
+// returned (after SetWrapErrors, if that is on). Together with OnWorkerStart this is enough for tracing or per-Worker
+// latency metrics without touching the Workers.
+//
+// The function is called by the Instance as it receives each result, before the error is acted on, so calls for one
+// Instance never overlap. A slow hook delays the Instance noticing later results, keep it short. Workers abandoned
+// because of SetStragglerGrace never finish, so this is not called for them. Pass nil to remove the hook.
+func (wg *Group) OnWorkerFinish(f func(id int, elapsed time.Duration, err error)) {
+	wg.opts.onWorkerFinish = f
+}
+
+// SetErrorThreshold sets how many Worker errors an Instance will tolerate before it aborts. The abort is ordered when
+// the n-th error is received, errors before that are recorded (see Instance.Errors) but otherwise ignored. If fewer
+// than n errors are received the Instance is considered successful and Wait will return nil.
+//
+// Zero (the default) or one means the first error aborts the Instance.
+func (wg *Group) SetErrorThreshold(n int) {
+	wg.opts.errorThreshold = n
+}
+
+// OnThresholdExceeded registers a function to be called when an Instance aborts because it reached its error threshold
+// (see SetErrorThreshold). It is passed the number of errors that counted towards the threshold. The function is called
+// at most once per Instance, from the goroutine managing the Instance, right after the abort is ordered.
+//
+// This is not called if the threshold is one or less (since then it's just a normal abort on the first error), or if
+// the Instance was already aborted for some other reason when the threshold was reached.
+func (wg *Group) OnThresholdExceeded(f func(count int)) {
+	wg.opts.onThreshold = f
+}
+
+// SetErrorWrapping controls whether Worker errors are wrapped with the Worker's registration index and copy number
+// before they are recorded, for example "Worker 1 (copy 2): connection refused". The original error can still be found
+// with errors.Is, errors.As, or errors.Unwrap. This is off by default.
+func (wg *Group) SetErrorWrapping(wrap bool) {
+	wg.opts.wrapErrors = wrap
+}
+
+// AbortIf sets a predicate that decides which Worker errors are fatal. When a Worker returns an error the predicate is
+// called with it, if it returns false the error is recorded (see Instance.Errors) but otherwise ignored, it will not
+// abort the Instance or be returned by Wait. Errors that pass the predicate are handled normally, including counting
+// towards the error threshold (see SetErrorThreshold).
+//
+// The predicate is only ever called from the goroutine managing the Instance, one error at a time. Pass nil to make
+// every error fatal again (the default).
+func (wg *Group) AbortIf(fatal func(err error) bool) {
+	wg.opts.abortIf = fatal
+}
+
+// SetDebugGoroutineIDs controls whether Instances record the goroutine ID of each Worker, see
+// Instance.GoroutineIDs. This is a debugging aid only, leave it off normally.
+func (wg *Group) SetDebugGoroutineIDs(debug bool) {
+	wg.opts.goroutineIDs = debug
+}
+
+// I debated using "Go" rather than "Start", but decided that "Start" was clearer.
+
+// Start launches a Group and returns the Instance tied to this particular run.
+//
+// "data" will be passed to the Group's Workers and Cleaners, it is perfectly fine to pass nil if
+// you do not need this value. If data implements Cancelable the Instance will abort when it is canceled.
+//
+// If the Group has no Workers the returned Instance will already be finished, with a nil error. The Group's Cleaners
+// will not be run in this case, as there is nothing for them to clean up (unless SetAlwaysClean was used, in which case
+// they are run before Start returns).
+//
+// Calling Wait (or any of the other ways of getting the result) is optional. An Instance that is never waited for still
+// runs its Cleaners and finishes normally, nothing blocks on the result, and once the Workers return everything
+// belonging to the Instance can be garbage collected. That said, dropping an Instance usually means an error went
+// unnoticed, see OnNeverWaited for a way to catch that during development.
+func (wg *Group) Start(data interface{}) *Instance {
+	return wg.start(data, wg.cleaners)
+}
+
+// StartNoClean is like Start, except the Group's Cleaners are not run for this Instance. Everything else (aborts,
+// errors, reporting) works as normal. This is for cases where the resources the Cleaners would free are owned by
+// something else for this particular run.
+//
+// Be careful with this! If the Cleaners are what closes files or connections stored in the data value, skipping them
+// will leak those resources unless you free them yourself.
+func (wg *Group) StartNoClean(data interface{}) *Instance {
+	return wg.start(data, nil)
+}
+
+// start does the actual work for Start and its variants. cleaners is the list of Cleaners the Instance should run,
+// normally the Group's.
+func (wg *Group) start(data interface{}, cleaners []cleaner) *Instance {
+	return wg.startWith(context.Background(), data, cleaners, nil, 0, 0)
+}
+
+// startWith is start with a parent context (see StartContext), checkpoints to resume from, a timeout (see
+// StartWithTimeout, zero for none), and a budget for the whole run including the Cleaners (see RunWithBudget, zero for
+// none).
+func (wg *Group) startWith(ctx context.Context, data interface{}, cleaners []cleaner,
+	resume map[int]interface{}, timeout, budget time.Duration) *Instance {
+	in := &Instance{abort: make(chan bool), drain: make(chan bool), done: make(chan bool), failed: make(chan bool),
+		opts: wg.opts}
+	in.parent = ctx
+	in.ctx, in.cancel = context.WithCancelCause(ctx)
+	in.group = *wg
+	in.started = time.Now()
+	if timeout > 0 {
+		// The deadline goes on the Instance's context so Workers can see it (see Instance.Deadline). Enforcing it is
+		// still up to watchTimeout, so the abort has the right cause.
+		var stop context.CancelFunc
+		in.deadline = in.started.Add(timeout)
+		in.ctx, stop = context.WithDeadline(in.ctx, in.deadline)
+		cancel := in.cancel
+		in.cancel = func(cause error) {
+			cancel(cause)
+			stop()
+		}
+	}
+	if budget > 0 {
+		in.cleanBy = in.started.Add(budget)
+	}
+	in.durations = map[int]time.Duration{}
+	in.controls = map[chan Command]bool{}
+	in.goroutines = map[int]int64{}
+	in.checkpoints = map[int]interface{}{}
+	in.emitted = map[int]interface{}{}
+	in.tags = map[string]string{}
+	if wg.opts.recordTimeline {
+		in.timeline = []Event{}
+	}
+	in.resume = resume
+	in.buffers.New = wg.opts.newBuffer
+	if wg.opts.maxConcurrent > 0 {
+		in.slots = newSlots(wg.opts.maxConcurrent, wg.opts.scheduler)
+	}
+	if f := wg.opts.onNeverWaited; f != nil {
+		runtime.SetFinalizer(in, func(in *Instance) {
+			if !in.isWaited() {
+				f(in.report)
+			}
+		})
+	}
+
+	// Cap the snapshot's slices so Instance.Add never writes into the Group's backing arrays.
+	in.group.workers = wg.workers[:len(wg.workers):len(wg.workers)]
+	in.group.counts = wg.counts[:len(wg.counts):len(wg.counts)]
+
+	total := 0
+	for _, c := range wg.counts {
+		total += c
+	}
+	in.data = data
+	in.total = total
+	in.running.Store(int64(total))
+	in.initial = total
+	in.changed = make(chan bool)
+
+	// rtn is buffered so that Workers launched by Start never block on it, even if the spawner runs them before run is
+	// started.
+	in.rtn = make(chan result, total)
+
+	// These must exist before any Worker is launched, as Workers may wait on each other (see AddNode).
+	in.returned = make([]chan bool, total)
+	for i := range in.returned {
+		in.returned[i] = make(chan bool)
+	}
+
+	in.entered.Add(total)
+	in.report.Workers = make([]WorkerReport, 0, total)
+	for i := range wg.workers {
+		for j := 0; j < wg.counts[i]; j++ {
+			in.report.Workers = append(in.report.Workers, WorkerReport{Index: i, Copy: j})
+		}
+	}
+	for id, w := range in.report.Workers {
+		in.launch(id, w.Index, w.Copy, wg.workers[w.Index])
+	}
+
+	if total == 0 {
+		// Nothing to wait for, so finish the Instance before returning it.
+		if !wg.opts.alwaysClean {
+			cleaners = nil
+		}
+		in.run(cleaners)
+		return in
+	}
+
+	if c, ok := data.(Cancelable); ok {
+		go func() {
+			select {
+			case <-c.Done():
+				in.Abort()
+			case <-in.done:
+			}
+		}()
+	}
+	in.watchHealth(data)
+	in.watchContext(ctx)
+	in.watchTimeout()
+
+	go in.run(cleaners)
+
+	return in
+}
+
+// StartChecked is like Start, except it calls Validate first. If the Group has any problems nothing is launched and
+// the validation error is returned instead of an Instance.
+func (wg *Group) StartChecked(data interface{}) (*Instance, error) {
+	if err := wg.Validate(); err != nil {
+		return nil, err
+	}
+	return wg.Start(data), nil
+}
+
+// StartWithAbort is like Start, except the Instance will also abort when the given channel is closed. This allows a
+// single channel to act as a master switch for many Instances. Instance.Abort still works as normal, and only
+// affects that one Instance.
+//
+// As with the Instance's own abort channel, never send a value on the given channel, only close it.
+func (wg *Group) StartWithAbort(data interface{}, abort <-chan bool) *Instance {
+	in := wg.Start(data)
+	in.watchAbort(abort)
+	return in
+}
+
+// Run launches a Group then waits for all the launched Workers to return, see Instance.Wait and Group.Start.
+func (wg *Group) Run(data interface{}) error {
+	// This whole system is one giant convenience method, so why not?
+	return wg.Start(data).Wait()
+}
+
+// Run is a shortcut for the most common case, it runs "count" copies of a single Worker and waits for them to return.
+// It behaves exactly like creating a Group, adding the Worker, and calling Group.Run.
+func Run(count int, data interface{}, worker Worker) error {
+	wg := new(Group)
+	wg.Add(count, worker)
+	return wg.Run(data)
+}
+
+// RunInstance is like Group.Run, except it also returns the finished Instance so you can inspect it afterwards (with
+// Report, WorkerDurations, etc).
+func (wg *Group) RunInstance(data interface{}) (*Instance, error) {
+	in := wg.Start(data)
+	return in, in.Wait()
+}
+
+// Instance is used to store state for a particular running instance of a Group.
+type Instance struct {
+	// Never, ever, ever send a value on any of these channels!
+
+	// abort is closed when an abort has been ordered.
+	abort chan bool
+
+	// drain is closed by Drain, and along with abort. It is only ever closed with the lock held.
+	drain chan bool
+
+	// Closed after all workers return. Functions waiting to use err block until reads succeed.
+	// There are better ways to do this, but they are more complicated.
+	done chan bool
+
+	// Closed when the first error is recorded if the Instance is in fail fast mode, never closed otherwise.
+	failed chan bool
+
+	// failErr is the error that caused failed to be closed. It is set once, before failed is closed, and then never
+	// touched again.
+	failErr error
+
+	// err hold the return value for calls to Wait for this Instance. It is protected by lock, always use getErr and
+	// setErr to access it. Wait won't return before done is closed, so it will never see anything but the final value.
+	err error
+
+	// errFromWorker is true if err is one of the errors in errs (from a Worker, Fallback, or Finalizer) rather than an
+	// abort or timeout error. Protected by lock, set along with err.
+	errFromWorker bool
+
+	// opts is a copy of the Group's settings at the time Start was called.
+	opts options
+
+	// started is the time the Instance was started.
+	started time.Time
+
+	// finished is the time the Instance finished, set right before done is closed.
+	finished time.Time
+
+	// ctx is canceled when abort is closed (with the reason as its cause), or when the Instance finishes. See
+	// StartContext.
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+
+	// parent is the context ctx was derived from.
+	parent context.Context
+
+	// deadline is when the Instance times out, zero if it has no timeout (see StartWithTimeout).
+	deadline time.Time
+
+	// cleanBy is when the Cleaners must be done, zero if there is no limit (see RunWithBudget).
+	cleanBy time.Time
+
+	// rng is returned by Rand. It is created by the first call, through rngOnce, since most Instances never use it.
+	rng     *rand.Rand
+	rngOnce sync.Once
+
+	// entered is released once by each Worker copy right before its function is called, see WaitStarted.
+	entered sync.WaitGroup
+
+	// group is a snapshot of the Group that started this Instance, used by RetryFailed.
+	group Group
+
+	// data is the value passed to Start.
+	data interface{}
+
+	// rtn carries results from the Workers to run.
+	rtn chan result
+
+	// slots hands out the right to run a Worker, nil if there is no limit (see SetMaxConcurrent).
+	slots *slots
+
+	// initial is the number of Workers launched by Start, as opposed to Instance.Add.
+	initial int
+
+	// running and returnedCount back Running and Completed. They are atomic so polling them never touches the lock.
+	running       atomic.Int64
+	returnedCount atomic.Int64
+
+	// startedCount counts the Workers that have been called, see SetCleanOnlyIfStarted.
+	startedCount atomic.Int64
+
+	// buffers is the pool used by GetBuffer and PutBuffer.
+	buffers sync.Pool
+
+	// report is filled in by run as Workers return. Until done is closed it may only be touched with the lock held,
+	// as Instance.Add may be appending to it.
+	report RunReport
+
+	// lock protects err and every field below this one that may change while the Instance is running (the maps,
+	// slices, and flags). It is also held when closing abort.
+	lock sync.Mutex
+
+	// abortCause is the reason abort was closed.
+	abortCause AbortCause
+
+	// abortErr is the error that caused abort to be closed, nil if it was closed by Abort (or the reason given to
+	// AbortWith).
+	abortErr error
+
+	// cleaning is set once all Workers have returned, just before the Cleaners start.
+	cleaning bool
+
+	// cleanErrs holds the errors encountered while running Cleaners.
+	cleanErrs []error
+
+	// errs holds every non-nil error returned by a Worker, in the order they were received.
+	errs []error
+
+	// onDone holds the callbacks registered with OnDone that have not been called yet.
+	onDone []func(err error)
+
+	// notified is set by run once it has taken the onDone callbacks. Any callbacks registered after this point are
+	// called directly by OnDone.
+	notified bool
+
+	// controls holds the channels of every running ControlWorker.
+	controls map[chan Command]bool
+
+	// goroutines maps Worker IDs to goroutine IDs, only filled in if the goroutineIDs option is set.
+	goroutines map[int]int64
+
+	// checkpoints holds the latest checkpoint saved by each Worker, keyed by Worker ID.
+	checkpoints map[int]interface{}
+
+	// resume holds the checkpoints from the Instance this one is resuming, it is never modified.
+	resume map[int]interface{}
+
+	// emitted holds the results passed to Emit, keyed by sequence number.
+	emitted map[int]interface{}
+
+	// durations holds the total time spent in each registration's Workers so far, keyed by registration index.
+	durations map[int]time.Duration
+
+	// tags holds the values set with SetTag.
+	tags map[string]string
+
+	// waited is set once anything asks for the result, see OnNeverWaited.
+	waited bool
+
+	// timeline holds the recorded events, it is only non-nil if the Group asked for a timeline.
+	timeline []Event
+
+	// nodeOrder holds the names of the nodes that have started, in order.
+	nodeOrder []string
+
+	// results holds the values returned by CollectorWorkers, in the order they returned.
+	results []interface{}
+
+	// collected holds the values returned by CollectorWorkers that run has not picked up yet, keyed by Worker ID.
+	collected map[int]interface{}
+
+	// sinkQueue buffers results for the sink when there is a result buffer, see SetResultBufferPolicy. sunk is closed
+	// once the sink has been given everything in it.
+	sinkQueue *resultQueue
+	sunk      chan bool
+
+	// spill holds the results past the spill threshold, and spilled is how many, see SetResultSpill. Only run touches
+	// them until the Cleaners start.
+	spill   *spillFile
+	spilled int
+
+	// retries counts the retries made by Workers added with AddRetry, see SetTotalRetryBudget.
+	retries atomic.Int64
+
+	// dropped counts the results thrown away by DropOldest.
+	dropped atomic.Int64
+
+	// total is the number of Workers launched so far, including those added with Instance.Add. Once sealed is set
+	// every one of them has returned, and no more may be added.
+	total  int
+	sealed bool
+
+	// returned has a channel for each Worker ID, closed once that Worker's result has been recorded.
+	returned []chan bool
+
+	// completed holds the results that have not been reported by WaitAny yet, and reportedAll is set once every
+	// result has been added to it. changed is closed (and replaced) whenever either changes.
+	completed   []result
+	reportedAll bool
+	changed     chan bool
+}
+
+// result is the value sent from a Worker's goroutine to run when the Worker returns.
+type result struct {
+	id  int
+	err error
+
+	// afterAbort is true if the abort channel was already closed when the Worker returned.
+	afterAbort bool
+
+	// elapsed is the wall clock time spent inside the Worker.
+	elapsed time.Duration
+}
+
+// setErr records err as the Instance's error.
+func (in *Instance) setErr(err error) {
+	in.lock.Lock()
+	in.err = err
+	in.errFromWorker = false
+	in.lock.Unlock()
+}
+
+// setWorkerErr is setErr for an error that was also appended to errs.
+func (in *Instance) setWorkerErr(err error) {
+	in.lock.Lock()
+	in.err = err
+	in.errFromWorker = true
+	in.lock.Unlock()
+}
+
+// getErr returns the Instance's error.
+func (in *Instance) getErr() error {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+	return in.err
+}
+
+// launch starts a Worker copy with the Group's spawner (or a plain go statement).
+func (in *Instance) launch(id, index, copy int, worker runner) {
+	fn := func() {
+		in.work(id, index, copy, worker)
+	}
+
+	if in.opts.spawner != nil {
+		in.opts.spawner(fn)
+		return
+	}
+	go fn()
+}
+
+// work runs a single Worker copy and sends its result to run.
+func (in *Instance) work(id, index, copy int, worker runner) {
+	if in.slots != nil && !in.acquire(id) {
+		// Aborted while queued, the Worker never runs.
+		if id < in.initial {
+			in.entered.Done()
+		}
+		in.send(result{id: id, afterAbort: true})
+		return
+	}
+
+	if in.opts.goroutineIDs {
+		gid := goroutineID()
+		in.lock.Lock()
+		in.goroutines[id] = gid
+		in.lock.Unlock()
+	}
+
+	if in.opts.onWorkerStart != nil {
+		in.opts.onWorkerStart(id)
+	}
+	if id < in.initial {
+		in.entered.Done()
+	}
+	in.startedCount.Add(1)
+	in.record(WorkerStarted, id, nil)
+
+	call := func() (err error) {
+		if in.opts.recoverPanics {
+			defer func() {
+				if r := recover(); r != nil {
+					err = &PanicError{Value: r, Stack: debug.Stack()}
+				}
+			}()
+		}
+		return worker(in, id, copy, in.data)
+	}
+
+	start := time.Now()
+	var err error
+	if in.opts.pprofLabels {
+		labels := pprof.Labels("workergroup.worker", strconv.Itoa(index), "workergroup.id", strconv.Itoa(id))
+		pprof.Do(context.Background(), labels, func(context.Context) {
+			err = call()
+		})
+	} else {
+		err = call()
+	}
+	elapsed := time.Since(start)
+	if in.slots != nil {
+		in.slots.release()
+	}
+	in.record(WorkerFinished, id, err)
+
+	// Check for an abort here rather than in run. The close and this check are ordered, so a Worker whose error
+	// triggers the abort is never reported as returning after it (run can't close the channel until it receives
+	// this result).
+	late := Aborted(in.abort)
+	if late && errors.Is(err, ErrAborted) {
+		// See CheckAbort.
+		err = nil
+	}
+
+	in.send(result{id, err, late, elapsed})
+}
+
+// acquire waits for a free slot (see SetMaxConcurrent), returning false if the Instance aborts first.
+func (in *Instance) acquire(id int) bool {
+	// Check the abort first, so a Worker that was queued when the abort was ordered never gets a slot.
+	select {
+	case <-in.abort:
+		return false
+	default:
+	}
+
+	return in.slots.acquire(id, in.abort)
+}
+
+// waitToStart calls wait, which blocks until a Worker can start (an AddNode dependency, an AddStaggered delay) and
+// returns false if it shouldn't start at all. The waiting is done without holding a slot (see SetMaxConcurrent), so
+// the Worker doesn't keep the Workers it is waiting on from running. The slot is taken back before waitToStart returns,
+// even if the Instance aborted in the meantime, as the caller still holds it as far as work is concerned.
+//
+// A waiting Worker hasn't really started, so it is only counted as started (see SetCleanOnlyIfStarted) once wait
+// returns true. run doesn't look at the count until every Worker has returned, so taking it back here is safe.
+func (in *Instance) waitToStart(id int, wait func() bool) (start bool) {
+	in.startedCount.Add(-1)
+	defer func() {
+		if start {
+			in.startedCount.Add(1)
+		}
+	}()
+
+	if in.slots == nil {
+		return wait()
+	}
+
+	in.slots.release()
+	defer in.slots.acquire(id, nil)
+	return wait()
+}
+
+// send hands a Worker's result to run. run reads every result until it has them all, so this only gives up if run has
+// stopped waiting for this Worker (see SetStragglerGrace).
+func (in *Instance) send(r result) {
+	select {
+	case in.rtn <- r:
+	case <-in.done:
+	}
+}
+
+// run manages all aspects of waiting for workers to return, including ordering aborts and launching cleaners.
+func (in *Instance) run(cleaners []cleaner) {
+	// fatal counts the errors that passed the AbortIf predicate, for the error threshold.
+	fatal := 0
+
+	// Once the Instance starts aborting, grace fires after the straggler grace period (if there is one). Until then it
+	// is nil and never ready.
+	var grace <-chan time.Time
+	var aborting <-chan bool
+	if in.opts.stragglerGrace > 0 {
+		aborting = in.abort
+	}
+
+	in.startSink()
+
+	received := 0
+results:
+	for {
+		// Workers may be added while this is running (see Instance.Add), so check the total each time around. Once
+		// every Worker has returned the Instance is sealed and no more can be added.
+		in.lock.Lock()
+		if received == in.total {
+			in.sealed = true
+			in.lock.Unlock()
+			break
+		}
+		in.lock.Unlock()
+
+		var r result
+		select {
+		case r = <-in.rtn:
+			received++
+			if v, ok := in.takeResult(r.id); ok && r.err == nil {
+				r.err = in.collect(v)
+			}
+		case <-aborting:
+			t := time.NewTimer(in.opts.stragglerGrace)
+			defer t.Stop()
+			grace, aborting = t.C, nil
+			continue
+		case <-grace:
+			in.abandon()
+			break results
+		}
+
+		in.lock.Lock()
+		w := &in.report.Workers[r.id]
+		if r.err != nil && in.opts.wrapErrors {
+			r.err = fmt.Errorf("Worker %d (copy %d): %w", w.Index, w.Copy, r.err)
+		}
+		w.Err = r.err
+		w.AfterAbort = r.afterAbort
+		w.Duration = r.elapsed
+		in.durations[w.Index] += r.elapsed
+		in.lock.Unlock()
+
+		if in.opts.onWorkerFinish != nil {
+			in.opts.onWorkerFinish(r.id, r.elapsed, r.err)
+		}
+
+		if r.err != nil {
+			in.workerError(r.err, &fatal)
+		}
+
+		// Only report the completion once the error has been dealt with, so anyone who sees a Worker return an error
+		// also sees the abort it caused.
+		in.complete(r)
+	}
+
+	in.lock.Lock()
+	in.reportedAll = true
+	in.notifyLocked()
+	in.lock.Unlock()
 
-// Add the given Worker to the Group.
-//
-// When the Group launches an Instance it will contain "count" copies of the given Worker.
-// If "count" is <= 0 then runtime.NumCPU copies of this worker will be launched.
-func (wg *Group) Add(count int, worker Worker) {
-	if count <= 0 {
-		count = runtime.NumCPU()
+	// Everything has been collected, let the sink catch up before anything (a Cleaner) can expect it to be done.
+	in.stopSink()
+	in.stopSpill()
+
+	// The Instance is sealed, so from here on nothing else touches the report or the Worker count.
+	data := in.data
+	total := in.total
+
+	recovered := false
+	if len(in.group.fallbacks) > 0 && total > 0 && in.allFailed() {
+		recovered = in.runFallbacks(data)
 	}
 
-	wg.workers = append(wg.workers, worker)
-	wg.counts = append(wg.counts, count)
+	if total > 0 {
+		for _, f := range in.group.finalizers {
+			if err := f(in.abort, data); err != nil {
+				in.lock.Lock()
+				in.errs = append(in.errs, err)
+				in.lock.Unlock()
+				in.setWorkerErr(err)
+			}
+		}
+	}
+
+	if in.opts.joinErrors {
+		in.joinErrors()
+	}
+
+	// The parent context may have been canceled before the watcher got around to aborting, if the Workers noticed the
+	// cancellation first and returned.
+	if err := in.parent.Err(); err != nil {
+		in.failAbort(ContextCanceled, err)
+	}
+
+	// Same for a timeout, a ContextWorker that noticed the deadline returns a clean context error.
+	if !in.deadline.IsZero() && !time.Now().Before(in.deadline) {
+		in.failAbort(TimedOut, ErrTimeout)
+	}
+
+	// Make sure that there is an error associated with every abort. This is done before the Cleaners run so the
+	// outcome they see is the same as the one Wait reports.
+	select {
+	case <-in.abort:
+		in.lock.Lock()
+		if in.err == nil && !recovered {
+			if in.abortCause == ExplicitAbort && in.abortErr != nil {
+				in.err = in.abortErr
+			} else if !in.opts.abortNotError {
+				in.err = NonErrorAbort
+			}
+		}
+		in.lock.Unlock()
+	default:
+	}
+
+	in.lock.Lock()
+	in.cleaning = true
+	in.lock.Unlock()
+
+	if in.opts.cleanIfRan && !in.opts.alwaysClean && in.startedCount.Load() == 0 {
+		cleaners = nil
+	}
+
+	final := in.runError(in.getErr())
+	failed := final != nil
+	var wg sync.WaitGroup
+	for i, c := range cleaners {
+		if (failed && c.onFailure) || (!failed && c.onSuccess) {
+			if !in.opts.concurrentClean {
+				in.clean(i, c, data, final)
+				continue
+			}
+
+			wg.Add(1)
+			go func(i int, c cleaner) {
+				defer wg.Done()
+				in.clean(i, c, data, final)
+			}(i, c)
+		}
+	}
+	wg.Wait()
+	in.removeSpill()
+
+	in.report.Elapsed = time.Since(in.started)
+	in.report.Retries = int(in.retries.Load())
+	in.report.TooShort = failed && in.report.Elapsed < in.opts.minRunDuration
+	in.report.Tags = in.Tags()
+	in.lock.Lock()
+	in.report.NodeOrder = append([]string(nil), in.nodeOrder...)
+	in.lock.Unlock()
+	in.finished = time.Now()
+	in.record(InstanceDone, -1, in.getErr())
+
+	// Release the context. If the Instance was aborted it was canceled at the same time, and this does nothing.
+	in.cancel(nil)
+
+	// Finally send the "done" signal.
+	close(in.done)
+
+	in.lock.Lock()
+	in.notified = true
+	callbacks := in.onDone
+	in.onDone = nil
+	in.lock.Unlock()
+
+	for _, f := range callbacks {
+		f(in.runError(in.getErr()))
+	}
 }
 
-// AddCleaner adds a Cleaner to the Group.
-func (wg *Group) AddCleaner(clean Cleaner) {
-	wg.cleaners = append(wg.cleaners, clean)
+// allFailed returns true if every Worker returned an error. Only call this from run after all Workers have returned.
+func (in *Instance) allFailed() bool {
+	for _, w := range in.report.Workers {
+		if w.Err == nil {
+			return false
+		}
+	}
+	return true
 }
 
-// I debated using "Go" rather than "Start", but decided that "Start" was clearer.
+// runFallbacks runs the Group's Fallbacks in order until one succeeds, returning true if one did.
+func (in *Instance) runFallbacks(data interface{}) bool {
+	errs := in.Errors()
+	never := make(chan bool)
+	for _, fb := range in.group.fallbacks {
+		err := fb(never, data, errs)
+		if err == nil {
+			in.setErr(nil)
+			return true
+		}
 
-// Start launches a Group and returns the Instance tied to this particular run.
-//
-// "data" will be passed to the Group's Workers and Cleaners, it is perfectly fine to pass nil if
-// you do not need this value.
-func (wg *Group) Start(data interface{}) *Instance {
-	in := &Instance{make(chan bool), make(chan bool), nil}
+		in.lock.Lock()
+		in.errs = append(in.errs, err)
+		in.lock.Unlock()
+		in.setWorkerErr(err)
+	}
+	return false
+}
 
-	rtn := make(chan error)
-	w := func(i int) {
-		rtn <- wg.workers[i](in.abort, data)
+// workerError records an error returned by a Worker and decides whether it aborts the Instance. fatal is the running
+// count of errors that passed the AbortIf predicate, for the error threshold.
+func (in *Instance) workerError(err error, fatal *int) {
+	in.lock.Lock()
+	in.errs = append(in.errs, err)
+	count := len(in.errs)
+	in.lock.Unlock()
+
+	policy := in.opts.errorPolicy
+	if policy != nil && !policy.Abort(err, count) {
+		// Not fatal, it is recorded in errs but otherwise ignored.
+		return
 	}
 
-	total := 0
-	for i := range wg.workers {
-		for j := 0; j < wg.counts[i]; j++ {
-			total++
-			go w(i)
-		}
+	if policy == nil && in.opts.abortIf != nil && !in.opts.abortIf(err) {
+		// Same as above.
+		return
+	}
+
+	*fatal++
+	if policy == nil && *fatal < in.opts.errorThreshold {
+		// Tolerated, same as above.
+		return
 	}
 
-	go in.run(data, wg.cleaners, total, rtn)
+	in.setWorkerErr(err)
+	if in.opts.failFast && in.failErr == nil {
+		in.failErr = err
+		close(in.failed)
+	}
 
-	return in
+	closed := in.closeAbort(WorkerError, err)
+	if closed && policy == nil && in.opts.errorThreshold > 1 && in.opts.onThreshold != nil {
+		in.opts.onThreshold(*fatal)
+	}
 }
 
-// Run launches a Group then waits for all the launched Workers to return, see Instance.Wait and Group.Start.
-func (wg *Group) Run(data interface{}) error {
-	// This whole system is one giant convenience method, so why not?
-	return wg.Start(data).Wait()
+// abandon gives up on every Worker that has not returned yet, see SetStragglerGrace.
+func (in *Instance) abandon() {
+	in.lock.Lock()
+	in.sealed = true
+	returned := in.returned
+	in.lock.Unlock()
+
+	for id, ch := range returned {
+		select {
+		case <-ch:
+			continue
+		default:
+		}
+
+		in.lock.Lock()
+		w := &in.report.Workers[id]
+		w.Err = ErrAbandoned
+		w.AfterAbort = true
+		w.Abandoned = true
+		in.lock.Unlock()
+
+		in.complete(result{id: id, err: ErrAbandoned, afterAbort: true})
+	}
 }
 
-// Instance is used to store state for a particular running instance of a Group.
-type Instance struct {
-	// Never, ever, ever send a value on either of these channels!
+// complete reports that a Worker has returned, to WaitAny and WaitWorker.
+func (in *Instance) complete(r result) {
+	in.lock.Lock()
+	defer in.lock.Unlock()
 
-	// abort is closed when an abort has been ordered.
-	abort chan bool
+	in.running.Add(-1)
+	in.returnedCount.Add(1)
 
-	// Closed after all workers return. Functions waiting to use err block until reads succeed.
-	// There are better ways to do this, but they are more complicated.
-	done chan bool
+	in.completed = append(in.completed, r)
+	close(in.returned[r.id])
+	in.notifyLocked()
+}
 
-	// err hold the return value for calls to Wait for this Instance. Since no call to Wait will return before
-	// done is closed, and this is set before that happens, there is no need for synchronization.
-	// Never, ever, set this outside of run!
-	err error
+// notifyLocked wakes up everything waiting on changed. The lock must be held.
+func (in *Instance) notifyLocked() {
+	close(in.changed)
+	in.changed = make(chan bool)
 }
 
-// run manages all aspects of waiting for workers to return, including ordering aborts and launching cleaners.
-func (in *Instance) run(data interface{}, cleaners []Cleaner, total int, rtn chan error) {
-	for i := 0; i < total; i++ {
-		err := <-rtn
-		if err != nil {
-			in.err = err
-			select {
-			case <-in.abort:
-			default:
-				close(in.abort)
+// clean runs a single Cleaner, enforcing its timeout (or what's left of the budget, see RunWithBudget) if it has one.
+// err is the final error, for CleanerE. A panic is recovered and recorded as a *CleanerPanicError.
+func (in *Instance) clean(i int, c cleaner, data interface{}, err error) {
+	fn := func() {
+		in.record(CleanerStarted, i, nil)
+		defer func() {
+			var perr error
+			if r := recover(); r != nil {
+				perr = &CleanerPanicError{Index: i, Value: r, Stack: debug.Stack()}
+				in.lock.Lock()
+				in.cleanErrs = append(in.cleanErrs, perr)
+				in.lock.Unlock()
 			}
+			in.record(CleanerFinished, i, perr)
+		}()
+
+		switch {
+		case c.withErr != nil:
+			c.withErr(data, err)
+		case c.withResults != nil:
+			c.withResults(data, in.collectedResults())
+		case c.withIterator != nil:
+			it := in.resultIterator()
+			defer it.close()
+			c.withIterator(data, it)
+		default:
+			c.fn(data)
+		}
+	}
+
+	timeout := c.timeout
+	if !in.cleanBy.IsZero() {
+		// What is left of the budget caps every Cleaner, once it is gone they are abandoned as soon as they start.
+		left := time.Until(in.cleanBy)
+		if left <= 0 {
+			left = time.Nanosecond
+		}
+		if timeout <= 0 || left < timeout {
+			timeout = left
 		}
 	}
 
-	for _, c := range cleaners {
-		c(data)
+	if timeout <= 0 {
+		fn()
+		return
 	}
 
-	// Make sure that there is an error associated with every abort.
+	finished := make(chan bool)
+	go func() {
+		fn()
+		close(finished)
+	}()
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
 	select {
-	case <-in.abort:
-		if in.err == nil {
-			in.err = NonErrorAbort
-		}
-	default:
+	case <-finished:
+	case <-t.C:
+		in.lock.Lock()
+		in.cleanErrs = append(in.cleanErrs, &CleanerTimeoutError{i, timeout})
+		in.lock.Unlock()
 	}
+}
 
-	// Finally send the "done" signal.
-	close(in.done)
+// CleanupErrors returns the problems encountered while running the Cleaners, such as Cleaners that timed out or
+// panicked. Like Wait this blocks until the Instance is done. These errors are not returned by Wait, since the Workers
+// themselves succeeded or failed independently of them.
+func (in *Instance) CleanupErrors() []error {
+	<-in.done
+
+	in.lock.Lock()
+	defer in.lock.Unlock()
+
+	errs := make([]error, len(in.cleanErrs))
+	copy(errs, in.cleanErrs)
+	return errs
 }
 
 // Wait will block until all Workers belonging to this Instance return.
 //
 // If one of the Workers returns a non-nil value the remaining Workers will be ordered to abort, then the error will
-// be returned. In the case that multiple Workers return errors only the last one received will be returned.
+// be returned. In the case that multiple Workers return errors only the last one received will be returned (use Errors
+// to get all of them, or see Group.SetJoinErrors).
 //
 // After the first call to Wait completes all subsequent calls to Wait return the result of the first call immediately.
 // If Wait is called while a previous call is still processing then the second call will block until the first call
 // finishes, then it will return the same result as the first.
+//
+// If the Group was in fail fast mode (see Group.SetFailFast) Wait returns the first error received as soon as it is
+// received, without waiting for the other Workers.
 func (in *Instance) Wait() error {
+	in.markWaited()
+
+	select {
+	case <-in.failed:
+	case <-in.done:
+	}
+
+	// Check failed again, if both were ready the select above may have picked either one.
+	select {
+	case <-in.failed:
+		return in.runError(in.failErr)
+	default:
+	}
+	return in.runError(in.getErr())
+}
+
+// ErrInstanceDone is returned by Instance.Add when every Worker has already returned.
+var ErrInstanceDone = errors.New("Instance has finished, Workers can no longer be added.")
+
+// Add launches "count" more copies of the given Worker as part of a running Instance, for example to scale up as a
+// queue grows. The new copies get the same abort channel and data value as the rest, and Wait and friends will not
+// return until they have returned too. If "count" is <= 0 then runtime.NumCPU copies are launched, as with Group.Add.
+//
+// The new copies are given the next free IDs (their entries are appended to RunReport.Workers) and together count as
+// a new registration, with the index after the Group's last one. They are not waited for by WaitStarted, and the Group
+// they came from is not changed.
+//
+// Workers can be added until the Instance is sealed, which happens as soon as every Worker has returned. After that
+// Add returns ErrInstanceDone. Adding Workers to an Instance that is aborting is allowed, but they will see the abort
+// right away.
+func (in *Instance) Add(count int, worker Worker) error {
+	if worker == nil {
+		return errors.New("Cannot add a nil Worker.")
+	}
+	if count <= 0 {
+		count = runtime.NumCPU()
+	}
+	r := func(in *Instance, id, copy int, data interface{}) error {
+		return worker(in.abort, data)
+	}
+
+	in.lock.Lock()
+	if in.sealed {
+		in.lock.Unlock()
+		return ErrInstanceDone
+	}
+	launch := in.addLocked(count, r)
+	in.lock.Unlock()
+
+	launch()
+	return nil
+}
+
+// addLocked registers count more copies of a Worker with a running Instance, see Add. The returned function launches
+// them, call it once the lock has been released. The lock must be held, and the Instance must not be sealed.
+func (in *Instance) addLocked(count int, r runner) (launch func()) {
+	index := len(in.group.workers)
+	in.group.workers = append(in.group.workers, r)
+	in.group.counts = append(in.group.counts, count)
+
+	first := len(in.report.Workers)
+	for j := 0; j < count; j++ {
+		in.report.Workers = append(in.report.Workers, WorkerReport{Index: index, Copy: j})
+		in.returned = append(in.returned, make(chan bool))
+	}
+	in.total += count
+	in.running.Add(int64(count))
+
+	return func() {
+		for j := 0; j < count; j++ {
+			in.launch(first+j, index, j, r)
+		}
+	}
+}
+
+// ErrAllReturned is returned by WaitAny when every Worker's completion has already been reported.
+var ErrAllReturned = errors.New("All Workers have already returned.")
+
+// WaitAny blocks until a Worker returns, then returns that Worker's ID (its index in RunReport.Workers) and the value
+// it returned. Each call reports the next completion, in the order they were received. Once every completion has been
+// reported WaitAny returns -1 and ErrAllReturned.
+//
+// WaitAny does not abort the other Workers, but the normal rules still apply: if the returned error is non-nil the
+// Instance will have been ordered to abort. If WaitAny is called from multiple goroutines each completion is only
+// reported to one of them.
+func (in *Instance) WaitAny() (int, error) {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+
+	for len(in.completed) == 0 {
+		if in.reportedAll {
+			return -1, ErrAllReturned
+		}
+
+		changed := in.changed
+		in.lock.Unlock()
+		<-changed
+		in.lock.Lock()
+	}
+
+	r := in.completed[0]
+	in.completed = in.completed[1:]
+	return r.id, r.err
+}
+
+// ErrNoSuchWorker is returned by WaitWorker if it is given an ID that does not belong to any Worker in the Instance.
+var ErrNoSuchWorker = errors.New("No Worker with the given ID exists in this Instance.")
+
+// WaitWorker blocks until the Worker with the given ID (its index in RunReport.Workers) returns, then returns the
+// value it returned. The other Workers are not waited for, and are not aborted.
+//
+// Every Worker ID belongs to a real goroutine, so this always returns eventually (assuming the Worker does). Workers
+// that are skipped without running their body, such as staggered copies that were aborted before they started, count
+// as returning nil.
+func (in *Instance) WaitWorker(id int) error {
+	ch, ok := in.returnedChan(id)
+	if !ok {
+		return ErrNoSuchWorker
+	}
+
+	<-ch
+	return in.workerErr(id)
+}
+
+// returnedChan returns the channel that is closed when the given Worker returns, or false if there is no such Worker.
+func (in *Instance) returnedChan(id int) (chan bool, bool) {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+
+	if id < 0 || id >= len(in.returned) {
+		return nil, false
+	}
+	return in.returned[id], true
+}
+
+// workerErr returns the error recorded for the given Worker. Only call this after it has returned.
+func (in *Instance) workerErr(id int) error {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+	return in.report.Workers[id].Err
+}
+
+// WaitStarted blocks until every Worker copy has begun running, that is, its goroutine has been scheduled and its
+// function has been called. A Worker that blocks as soon as it is entered still counts as started. For AddStaggered
+// Workers the start delay is part of the Worker, so WaitStarted does not wait for it.
+//
+// This is mostly useful in tests, to make sure everything is up before sending the first job or ordering an abort.
+// Don't call it on an Instance running under SetTestMode without stepping the pending Workers, it will never return.
+func (in *Instance) WaitStarted() {
+	in.entered.Wait()
+}
+
+// WaitDrain is like Wait, except it always blocks until every Worker has returned and the Cleaners have run, even in
+// fail fast mode. The error returned is the one Wait would return if fail fast mode was off.
+func (in *Instance) WaitDrain() error {
+	in.markWaited()
 	<-in.done
-	return in.err
+	return in.runError(in.getErr())
+}
+
+// OnDone registers a function to be called with the final error once all Workers have returned and the Cleaners have
+// run. The error is the same one WaitDrain returns.
+//
+// Each registered function is called exactly once, in the order they were registered, from the goroutine that manages
+// the Instance. If the Instance has already finished the function is called immediately, before OnDone returns.
+func (in *Instance) OnDone(f func(err error)) {
+	in.lock.Lock()
+	in.waited = true
+	if !in.notified {
+		in.onDone = append(in.onDone, f)
+		in.lock.Unlock()
+		return
+	}
+	in.lock.Unlock()
+
+	f(in.runError(in.getErr()))
+}
+
+// joinErrors replaces a Worker error with all of them joined together, see SetJoinErrors.
+func (in *Instance) joinErrors() {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+
+	// Errors can't be compared with == (they may not be comparable types), so this relies on errFromWorker to know that
+	// err came from errs rather than from a timeout or similar.
+	if len(in.errs) < 2 || !in.errFromWorker {
+		return
+	}
+	in.err = errors.Join(in.errs...)
+}
+
+// markWaited records that the Instance's result has been asked for.
+func (in *Instance) markWaited() {
+	in.lock.Lock()
+	in.waited = true
+	in.lock.Unlock()
+}
+
+// isWaited returns true if markWaited has been called.
+func (in *Instance) isWaited() bool {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+	return in.waited
+}
+
+// WorkerDurations returns the total wall clock time spent in each registration's Workers, keyed by registration index
+// (the order the Workers were added to the Group). Copies of the same Worker are summed together.
+//
+// This may be called while the Instance is running, in which case only the Workers that have returned so far are
+// counted. It is intended as a lightweight way to see which part of a Group is the bottleneck.
+func (in *Instance) WorkerDurations() map[int]time.Duration {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+
+	durations := make(map[int]time.Duration, len(in.durations))
+	for k, v := range in.durations {
+		durations[k] = v
+	}
+	return durations
+}
+
+// Errors returns every non-nil error returned by a Worker so far, in the order they were received. Unlike Wait this
+// does not block, so it may be used to monitor a running Instance.
+func (in *Instance) Errors() []error {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+
+	errs := make([]error, len(in.errs))
+	copy(errs, in.errs)
+	return errs
+}
+
+// ErrorCount returns the number of Worker errors received so far, including ones that were tolerated because of an
+// error threshold or AbortIf predicate. This is cheaper than len(Errors()) and is intended for monitoring how close a
+// running Instance is to its error threshold.
+func (in *Instance) ErrorCount() int {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+	return len(in.errs)
+}
+
+// Running returns the number of Workers that have not returned yet. Workers added with Instance.Add are counted as soon
+// as Add returns. This doesn't touch the lock, so it is cheap enough to poll for a progress display.
+//
+// Once Done is true this is always zero.
+func (in *Instance) Running() int {
+	return int(in.running.Load())
+}
+
+// Completed returns the number of Workers that have returned so far, see Running.
+func (in *Instance) Completed() int {
+	return int(in.returnedCount.Load())
+}
+
+// State describes what stage of its life an Instance is in, see Instance.State.
+type State int
+
+const (
+	// StateRunning means the Instance's Workers are running normally.
+	StateRunning State = iota
+
+	// StateAborting means an abort has been ordered, but some Workers have not returned yet.
+	StateAborting
+
+	// StateCleaning means every Worker has returned and the Cleaners are running.
+	StateCleaning
+
+	// StateDone means the Instance is finished, Wait will return immediately.
+	StateDone
+)
+
+func (s State) String() string {
+	switch s {
+	case StateRunning:
+		return "running"
+	case StateAborting:
+		return "aborting"
+	case StateCleaning:
+		return "cleaning"
+	case StateDone:
+		return "done"
+	default:
+		return "State(" + strconv.Itoa(int(s)) + ")"
+	}
+}
+
+// State returns the current state of the Instance. States only ever move forward (though an Instance may skip
+// StateAborting entirely), so once you see a given state you will never see an earlier one.
+func (in *Instance) State() State {
+	if in.Done() {
+		return StateDone
+	}
+
+	in.lock.Lock()
+	cleaning := in.cleaning
+	in.lock.Unlock()
+	if cleaning {
+		return StateCleaning
+	}
+
+	select {
+	case <-in.abort:
+		return StateAborting
+	default:
+		return StateRunning
+	}
 }
 
 // Done returns true if all Workers for this Instance have returned. Generally you should just call Wait (as if the
@@ -208,11 +2289,129 @@ func (in *Instance) Done() bool {
 // Where possible you should have a dedicated exit Worker to handle things such as timeouts, but where that is not
 // possible or desired this function may be used.
 //
-// Wait will return NonErrorAbort unless there is another error between the abort being ordered and final return.
+// Wait will return NonErrorAbort unless there is another error between the abort being ordered and final return (or
+// the Group was configured with SetAbortIsError(false), in which case it will return nil).
 func (in *Instance) Abort() {
+	in.closeAbort(ExplicitAbort, nil)
+}
+
+// AbortWith is Abort with a reason. If no Worker returns an error Wait will return "reason" instead of NonErrorAbort,
+// even if the Group was configured with SetAbortIsError(false). A real Worker error still takes precedence.
+//
+// Like Abort only the first call has any effect, later calls (or calls after an abort was ordered some other way) do
+// not change the reason. A nil reason is the same as calling Abort.
+func (in *Instance) AbortWith(reason error) {
+	in.closeAbort(ExplicitAbort, reason)
+}
+
+// watchAbort aborts the Instance when the given channel is closed. The watching goroutine exits when the Instance
+// finishes.
+func (in *Instance) watchAbort(abort <-chan bool) {
+	if abort == nil {
+		return
+	}
+
+	go func() {
+		select {
+		case <-abort:
+			in.Abort()
+		case <-in.done:
+		}
+	}()
+}
+
+// closeAbort closes the abort channel if it is not already closed, and records why along with the error that caused
+// it (if any). Only the first call has any effect. Closing under the lock is what makes it safe for both run and Abort
+// to do this from different goroutines, and it ensures the recorded cause always matches whoever actually closed it.
+//
+// Returns true if this call is the one that closed the channel.
+func (in *Instance) closeAbort(reason AbortCause, cause error) bool {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+	return in.closeAbortLocked(reason, cause)
+}
+
+// failAbort is closeAbort for problems that are not Worker errors (which run records itself). If this call closes the
+// channel the cause also becomes the Instance's error. Once the Cleaners have started this does nothing. Doing both
+// under the lock means run can never see the abort without the error and record NonErrorAbort instead.
+func (in *Instance) failAbort(reason AbortCause, cause error) bool {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+
+	// Once the Cleaners have started the outcome is settled, it's too late to fail.
+	if in.cleaning || !in.closeAbortLocked(reason, cause) {
+		return false
+	}
+	in.err = cause
+	in.errFromWorker = false
+	return true
+}
+
+// closeAbortLocked is closeAbort for callers that already hold the lock.
+func (in *Instance) closeAbortLocked(reason AbortCause, cause error) bool {
 	select {
 	case <-in.abort:
+		return false
 	default:
+		in.abortCause = reason
+		in.abortErr = cause
 		close(in.abort)
+		in.closeDrainLocked()
+
+		if cause == nil {
+			cause = NonErrorAbort
+		}
+		in.cancel(cause)
+		in.recordLocked(Event{Kind: AbortOrdered, ID: -1, Cause: reason, Err: cause})
+		return true
 	}
 }
+
+// AbortCausingError returns the error that caused the Instance to abort: a Worker error, or the health check, context,
+// or timeout error. This is the error that was received when the abort was ordered, which is not necessarily the same
+// as the (last) error returned by Wait. If the Instance has not aborted, or was aborted explicitly, this returns nil
+// (or the reason given to AbortWith).
+func (in *Instance) AbortCausingError() error {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+	return in.abortErr
+}
+
+// AbortCause returns the reason the Instance was aborted, or NotAborted if it hasn't been.
+func (in *Instance) AbortCause() AbortCause {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+	return in.abortCause
+}
+
+// GetBuffer borrows an object from the Instance's buffer pool (see Group.SetBufferPool). If the Group does not have
+// a buffer pool set this returns nil.
+//
+// It is safe to call GetBuffer from multiple Workers at once.
+func (in *Instance) GetBuffer() interface{} {
+	return in.buffers.Get()
+}
+
+// PutBuffer returns an object borrowed with GetBuffer to the pool so it can be reused. Don't keep using an object
+// after you have returned it!
+func (in *Instance) PutBuffer(b interface{}) {
+	in.buffers.Put(b)
+}
+
+// AbortWait orders an abort, then blocks until every Worker has returned and the Cleaners have run (even in fail fast
+// mode). The returned error is whatever Wait would return. It is safe to call this at the same time as Abort, Wait, or
+// another AbortWait.
+func (in *Instance) AbortWait() error {
+	in.Abort()
+	in.WaitDrain()
+	return in.Wait()
+}
+
+// Close is the same as AbortWait. It allows an Instance to be used as an io.Closer, for example with
+// "defer in.Close()".
+//
+// Keep in mind that since Close always orders an abort, if no Worker failed the returned error is the same error Wait
+// returns after an explicit abort (NonErrorAbort, or nil with SetAbortIsError(false)).
+func (in *Instance) Close() error {
+	return in.AbortWait()
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2016 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package workergroup_test
+
+import (
+	"runtime"
+	"syscall"
+	"testing"
+
+	worker "github.com/milochristiansen/workergroup"
+)
+
+func TestAddLockedThread(t *testing.T) {
+	// Keep the scheduler busy so an unlocked goroutine is likely to move between threads.
+	stop := make(chan bool)
+	defer close(stop)
+	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+		go func() {
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					runtime.Gosched()
+				}
+			}
+		}()
+	}
+
+	wg := new(worker.Group)
+	wg.AddLocked(2, func(abort <-chan bool, data interface{}) error {
+		tid := syscall.Gettid()
+		for i := 0; i < 50; i++ {
+			// A blocking system call gives up the P, so an unlocked goroutine usually resumes on another thread.
+			ts := syscall.Timespec{Nsec: 100000}
+			syscall.Nanosleep(&ts, nil)
+			if now := syscall.Gettid(); now != tid {
+				t.Errorf("Worker moved from thread %d to %d.", tid, now)
+				return nil
+			}
+		}
+		return nil
+	})
+	if err := wg.Run(nil); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
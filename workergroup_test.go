@@ -0,0 +1,3306 @@
+/*
+Copyright 2016 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package workergroup_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	worker "github.com/milochristiansen/workergroup"
+	"github.com/milochristiansen/workergroup/workergrouptest"
+)
+
+var errTest = errors.New("test error")
+
+func TestReportAfterAbort(t *testing.T) {
+	wg := new(worker.Group)
+	wg.Add(1, func(abort <-chan bool, data interface{}) error {
+		return errTest
+	})
+	wg.Add(1, func(abort <-chan bool, data interface{}) error {
+		<-abort
+		return errTest
+	})
+
+	r := wg.Start(nil).Report()
+	if len(r.Workers) != 2 {
+		t.Fatalf("expected 2 workers in report, got %d", len(r.Workers))
+	}
+	if r.Workers[0].AfterAbort {
+		t.Error("the Worker that caused the abort was reported as returning after it")
+	}
+	if !r.Workers[1].AfterAbort {
+		t.Error("the Worker that waited for the abort was reported as returning before it")
+	}
+}
+
+func TestAbortIsError(t *testing.T) {
+	wg := new(worker.Group)
+	wg.Add(1, func(abort <-chan bool, data interface{}) error {
+		<-abort
+		return nil
+	})
+
+	in := wg.Start(nil)
+	in.Abort()
+	if err := in.Wait(); err != worker.NonErrorAbort {
+		t.Errorf("expected NonErrorAbort by default, got %v", err)
+	}
+
+	wg.SetAbortIsError(false)
+	in = wg.Start(nil)
+	in.Abort()
+	if err := in.Wait(); err != nil {
+		t.Errorf("expected nil with SetAbortIsError(false), got %v", err)
+	}
+}
+
+func TestIsAbort(t *testing.T) {
+	if !worker.IsAbort(worker.NonErrorAbort) {
+		t.Error("IsAbort(NonErrorAbort) returned false")
+	}
+	if !worker.IsAbort(fmt.Errorf("wrapped: %w", worker.NonErrorAbort)) {
+		t.Error("IsAbort returned false for a wrapped NonErrorAbort")
+	}
+	if worker.IsAbort(errTest) || worker.IsAbort(nil) {
+		t.Error("IsAbort returned true for a non-abort error")
+	}
+}
+
+func TestIsTimeout(t *testing.T) {
+	if !worker.IsTimeout(worker.ErrTimeout) || !worker.IsTimeout(context.DeadlineExceeded) {
+		t.Error("IsTimeout returned false for a timeout")
+	}
+	if !worker.IsTimeout(fmt.Errorf("wrapped: %w", worker.ErrTimeout)) {
+		t.Error("IsTimeout returned false for a wrapped ErrTimeout")
+	}
+	if worker.IsTimeout(errTest) || worker.IsTimeout(worker.NonErrorAbort) || worker.IsTimeout(nil) {
+		t.Error("IsTimeout returned true for a non-timeout error")
+	}
+
+	wg := new(worker.Group)
+	wg.Add(1, func(abort <-chan bool, data interface{}) error {
+		<-abort
+		return nil
+	})
+	if err := wg.RunWithTimeout(nil, time.Millisecond); !worker.IsTimeout(err) {
+		t.Errorf("Expected a timeout, got: %v", err)
+	}
+}
+
+func TestFailFast(t *testing.T) {
+	release := make(chan bool)
+
+	wg := new(worker.Group)
+	wg.SetFailFast(true)
+	wg.Add(1, func(abort <-chan bool, data interface{}) error {
+		return errTest
+	})
+	wg.Add(1, func(abort <-chan bool, data interface{}) error {
+		<-release
+		return nil
+	})
+
+	in := wg.Start(nil)
+	if err := in.Wait(); err != errTest {
+		t.Errorf("expected errTest from Wait, got %v", err)
+	}
+	if in.Done() {
+		t.Error("Instance reported done while a Worker was still running")
+	}
+
+	close(release)
+	if err := in.WaitDrain(); err != errTest {
+		t.Errorf("expected errTest from WaitDrain, got %v", err)
+	}
+}
+
+func TestOnDone(t *testing.T) {
+	wg := new(worker.Group)
+	wg.Add(2, func(abort <-chan bool, data interface{}) error {
+		return errTest
+	})
+
+	in := wg.Start(nil)
+	calls := make(chan error, 2)
+	in.OnDone(func(err error) { calls <- err })
+	in.Wait()
+	in.OnDone(func(err error) { calls <- err })
+
+	for i := 0; i < 2; i++ {
+		if err := <-calls; err != errTest {
+			t.Errorf("expected errTest passed to OnDone callback, got %v", err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	wg := new(worker.Group)
+	if err := wg.Validate(); !errors.Is(err, worker.ErrNoWorkers) {
+		t.Errorf("expected ErrNoWorkers for an empty Group, got %v", err)
+	}
+
+	wg.Add(1, nil)
+	wg.AddCleaner(nil)
+	err := wg.Validate()
+	verr, ok := err.(*worker.ValidationError)
+	if !ok {
+		t.Fatalf("expected a *ValidationError, got %v", err)
+	}
+	if len(verr.Problems) != 2 {
+		t.Errorf("expected 2 problems (nil Worker and nil Cleaner), got %v", verr.Problems)
+	}
+}
+
+func TestEmptyGroup(t *testing.T) {
+	cleaned := false
+	wg := new(worker.Group)
+	wg.AddCleaner(func(data interface{}) {
+		cleaned = true
+	})
+
+	in := wg.Start(nil)
+	if !in.Done() {
+		t.Error("Instance for an empty Group was not already done")
+	}
+	if err := in.Wait(); err != nil {
+		t.Errorf("expected nil error for an empty Group, got %v", err)
+	}
+	if cleaned {
+		t.Error("Cleaner ran for an empty Group")
+	}
+
+	wg.SetAlwaysClean(true)
+	wg.Run(nil)
+	if !cleaned {
+		t.Error("Cleaner did not run for an empty Group with SetAlwaysClean(true)")
+	}
+}
+
+func TestWaitAny(t *testing.T) {
+	wg := new(worker.Group)
+	wg.Add(3, func(abort <-chan bool, data interface{}) error {
+		return nil
+	})
+
+	in := wg.Start(nil)
+	seen := map[int]bool{}
+	for i := 0; i < 3; i++ {
+		id, err := in.WaitAny()
+		if err != nil {
+			t.Fatalf("unexpected error from WaitAny: %v", err)
+		}
+		seen[id] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("expected 3 distinct Worker IDs, got %v", seen)
+	}
+	if id, err := in.WaitAny(); id != -1 || err != worker.ErrAllReturned {
+		t.Errorf("expected -1 and ErrAllReturned once exhausted, got %d and %v", id, err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	wg := new(worker.Group)
+	wg.Add(2, func(abort <-chan bool, data interface{}) error {
+		<-abort
+		return nil
+	})
+
+	var c io.Closer = wg.Start(nil)
+	if err := c.Close(); err != worker.NonErrorAbort {
+		t.Errorf("expected NonErrorAbort from Close, got %v", err)
+	}
+
+	wg.SetAbortIsError(false)
+	c = wg.Start(nil)
+	if err := c.Close(); err != nil {
+		t.Errorf("expected nil from Close with SetAbortIsError(false), got %v", err)
+	}
+}
+
+func TestWorkerDurations(t *testing.T) {
+	wg := new(worker.Group)
+	wg.Add(1, func(abort <-chan bool, data interface{}) error {
+		return nil
+	})
+	wg.Add(2, func(abort <-chan bool, data interface{}) error {
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	})
+
+	in := wg.Start(nil)
+	in.Wait()
+	d := in.WorkerDurations()
+	if len(d) != 2 {
+		t.Fatalf("expected durations for 2 registrations, got %v", d)
+	}
+	if d[1] < 20*time.Millisecond {
+		t.Errorf("expected at least 20ms for registration 1, got %v", d[1])
+	}
+}
+
+func TestConcurrentStart(t *testing.T) {
+	wg := new(worker.Group)
+	wg.Add(2, func(abort <-chan bool, data interface{}) error {
+		return nil
+	})
+	wg.AddCleaner(func(data interface{}) {})
+
+	errs := make(chan error)
+	for i := 0; i < 50; i++ {
+		go func() {
+			errs <- wg.Run(nil)
+		}()
+	}
+	for i := 0; i < 50; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("unexpected error from concurrent Run: %v", err)
+		}
+	}
+}
+
+func TestSpawner(t *testing.T) {
+	spawned := 0
+	wg := new(worker.Group)
+	wg.SetSpawner(func(fn func()) {
+		spawned++
+		go fn()
+	})
+	wg.Add(3, func(abort <-chan bool, data interface{}) error {
+		return nil
+	})
+
+	if err := wg.Run(nil); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if spawned != 3 {
+		t.Errorf("expected the spawner to be called 3 times, got %d", spawned)
+	}
+}
+
+func TestCancelableData(t *testing.T) {
+	wg := new(worker.Group)
+	wg.Add(2, func(abort <-chan bool, data interface{}) error {
+		<-abort
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	in := wg.Start(ctx)
+	cancel()
+	if err := in.Wait(); err != worker.NonErrorAbort {
+		t.Errorf("expected NonErrorAbort after canceling the data value, got %v", err)
+	}
+}
+
+func TestCombine(t *testing.T) {
+	order := []int{}
+	a, b := new(worker.Group), new(worker.Group)
+	a.Add(2, func(abort <-chan bool, data interface{}) error { return nil })
+	a.AddCleaner(func(data interface{}) { order = append(order, 1) })
+	b.Add(1, func(abort <-chan bool, data interface{}) error { return nil })
+	b.AddCleaner(func(data interface{}) { order = append(order, 2) })
+
+	r, err := worker.Combine(a, nil, b).Start(nil).WaitReport()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if len(r.Workers) != 3 || r.Workers[2].Index != 1 {
+		t.Errorf("unexpected Workers in combined report: %+v", r.Workers)
+	}
+	if len(order) != 2 || order[0] != 1 || order[1] != 2 {
+		t.Errorf("Cleaners ran in the wrong order: %v", order)
+	}
+}
+
+func TestClone(t *testing.T) {
+	var lock sync.Mutex
+	starts, cleans := 0, 0
+
+	wg := new(worker.Group)
+	wg.Add(1, func(abort <-chan bool, data interface{}) error { return errTest })
+	wg.AddCleaner(func(data interface{}) {
+		lock.Lock()
+		cleans++
+		lock.Unlock()
+	})
+	wg.SetErrorWrapping(true)
+	wg.SetAbortIsError(false)
+	wg.OnWorkerStart(func(id int) {
+		lock.Lock()
+		starts++
+		lock.Unlock()
+	})
+
+	c := wg.Clone()
+	c.Add(1, func(abort <-chan bool, data interface{}) error {
+		<-abort
+		return nil
+	})
+
+	if p := wg.Plan(); p.Total != 1 {
+		t.Errorf("Adding to the clone changed the original: %+v", p)
+	}
+
+	for _, g := range []*worker.Group{wg, c} {
+		err := g.Start(nil).Wait()
+		if !errors.Is(err, errTest) || err == errTest {
+			t.Errorf("Expected a wrapped errTest, got: %v", err)
+		}
+	}
+
+	if starts != 3 || cleans != 2 {
+		t.Errorf("Clone lost hooks or Cleaners: %d starts, %d cleans", starts, cleans)
+	}
+}
+
+func TestAddCritical(t *testing.T) {
+	finished := false
+	wg := new(worker.Group)
+	wg.AddCritical(1, func(abort <-chan bool, data interface{}) error {
+		select {
+		case <-abort:
+			return nil
+		case <-time.After(20 * time.Millisecond):
+		}
+		finished = true
+		return nil
+	})
+
+	in := wg.Start(nil)
+	in.Abort()
+	in.Wait()
+	if !finished {
+		t.Error("critical Worker was aborted")
+	}
+}
+
+func TestTestMode(t *testing.T) {
+	order := []int{}
+	wg := new(worker.Group)
+	for i := 0; i < 3; i++ {
+		i := i
+		wg.Add(1, func(abort <-chan bool, data interface{}) error {
+			order = append(order, i)
+			return nil
+		})
+	}
+
+	ctl := new(worker.TestController)
+	wg.SetTestMode(ctl)
+	in := wg.Start(nil)
+	if ctl.Pending() != 3 {
+		t.Fatalf("expected 3 pending Workers, got %d", ctl.Pending())
+	}
+	ctl.Step(2)
+	ctl.RunAll()
+	in.Wait()
+
+	if len(order) != 3 || order[0] != 2 || order[1] != 0 || order[2] != 1 {
+		t.Errorf("Workers ran in the wrong order: %v", order)
+	}
+}
+
+func TestRetryFailed(t *testing.T) {
+	var lock sync.Mutex
+	calls := 0
+	wg := new(worker.Group)
+	wg.Add(3, func(abort <-chan bool, data interface{}) error {
+		lock.Lock()
+		defer lock.Unlock()
+		calls++
+		if calls == 1 {
+			return errTest
+		}
+		return nil
+	})
+
+	in := wg.Start(nil)
+	if err := in.Wait(); err != errTest {
+		t.Fatalf("expected errTest, got %v", err)
+	}
+
+	retry := in.RetryFailed(nil)
+	r, err := retry.WaitReport()
+	if err != nil {
+		t.Errorf("unexpected error from retry: %v", err)
+	}
+	if len(r.Workers) != 1 {
+		t.Errorf("expected 1 Worker in the retry, got %d", len(r.Workers))
+	}
+}
+
+func TestErrorThreshold(t *testing.T) {
+	wg := new(worker.Group)
+	wg.SetErrorThreshold(3)
+	wg.Add(2, func(abort <-chan bool, data interface{}) error {
+		return errTest
+	})
+
+	in := wg.Start(nil)
+	if err := in.Wait(); err != nil {
+		t.Errorf("expected nil with errors below the threshold, got %v", err)
+	}
+	if len(in.Errors()) != 2 {
+		t.Errorf("expected 2 recorded errors, got %v", in.Errors())
+	}
+
+	crossed := 0
+	wg.OnThresholdExceeded(func(count int) {
+		crossed = count
+	})
+	wg.Add(1, func(abort <-chan bool, data interface{}) error {
+		return errTest
+	})
+	if err := wg.Run(nil); err != errTest {
+		t.Errorf("expected errTest once the threshold was reached, got %v", err)
+	}
+	if crossed != 3 {
+		t.Errorf("expected OnThresholdExceeded to be called with 3, got %d", crossed)
+	}
+}
+
+func TestAbortCausingError(t *testing.T) {
+	errLate := errors.New("late error")
+	wg := new(worker.Group)
+	wg.Add(1, func(abort <-chan bool, data interface{}) error {
+		return errTest
+	})
+	wg.Add(1, func(abort <-chan bool, data interface{}) error {
+		<-abort
+		return errLate
+	})
+
+	in := wg.Start(nil)
+	if err := in.Wait(); err != errLate {
+		t.Errorf("expected the last error from Wait, got %v", err)
+	}
+	if err := in.AbortCausingError(); err != errTest {
+		t.Errorf("expected the first error from AbortCausingError, got %v", err)
+	}
+}
+
+func TestStartWithAbort(t *testing.T) {
+	wg := new(worker.Group)
+	wg.Add(1, func(abort <-chan bool, data interface{}) error {
+		<-abort
+		return nil
+	})
+
+	master := make(chan bool)
+	a, b := wg.StartWithAbort(nil, master), wg.StartWithAbort(nil, master)
+	close(master)
+	if err := a.Wait(); err != worker.NonErrorAbort {
+		t.Errorf("expected NonErrorAbort, got %v", err)
+	}
+	if err := b.Wait(); err != worker.NonErrorAbort {
+		t.Errorf("expected NonErrorAbort, got %v", err)
+	}
+}
+
+func TestConditionalCleaners(t *testing.T) {
+	var fail bool
+	var ran []string
+	wg := new(worker.Group)
+	wg.Add(1, func(abort <-chan bool, data interface{}) error {
+		if fail {
+			return errTest
+		}
+		return nil
+	})
+	wg.AddSuccessCleaner(func(data interface{}) { ran = append(ran, "success") })
+	wg.AddFailureCleaner(func(data interface{}) { ran = append(ran, "failure") })
+	wg.AddCleaner(func(data interface{}) { ran = append(ran, "always") })
+
+	wg.Run(nil)
+	if len(ran) != 2 || ran[0] != "success" || ran[1] != "always" {
+		t.Errorf("wrong Cleaners ran on success: %v", ran)
+	}
+
+	ran, fail = nil, true
+	wg.Run(nil)
+	if len(ran) != 2 || ran[0] != "failure" || ran[1] != "always" {
+		t.Errorf("wrong Cleaners ran on failure: %v", ran)
+	}
+}
+
+func TestControlWorker(t *testing.T) {
+	started := make(chan bool)
+	wg := new(worker.Group)
+	wg.AddControl(2, func(abort <-chan bool, control <-chan worker.Command, data interface{}) error {
+		started <- true
+		cmd := <-control
+		if cmd != "stop" {
+			return errTest
+		}
+		return nil
+	})
+
+	in := wg.Start(nil)
+	<-started
+	<-started
+	if n := in.Send("stop"); n != 2 {
+		t.Errorf("expected the Command to be sent to 2 Workers, got %d", n)
+	}
+	if err := in.Wait(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestRunEvery(t *testing.T) {
+	var lock sync.Mutex
+	runs := 0
+	wg := new(worker.Group)
+	wg.Add(1, func(abort <-chan bool, data interface{}) error {
+		lock.Lock()
+		runs++
+		lock.Unlock()
+		return nil
+	})
+
+	stop := wg.RunEvery(5*time.Millisecond, nil)
+	time.Sleep(50 * time.Millisecond)
+	stop()
+	stop()
+
+	lock.Lock()
+	defer lock.Unlock()
+	if runs < 2 {
+		t.Errorf("expected several scheduled runs, got %d", runs)
+	}
+}
+
+func TestRunEveryJitter(t *testing.T) {
+	const interval, jitter = 2 * time.Millisecond, 50 * time.Millisecond
+
+	// A source with the same seed draws the same delays, so the schedule is known in advance.
+	expected := rand.New(rand.NewSource(42))
+	var due []time.Duration
+	total := time.Duration(0)
+	for i := 0; i < 3; i++ {
+		total += interval + time.Duration(expected.Int63n(int64(jitter)+1))
+		due = append(due, total)
+	}
+
+	starts := make(chan time.Time, 10)
+	wg := new(worker.Group)
+	wg.Add(1, func(abort <-chan bool, data interface{}) error { return nil })
+	begin := time.Now()
+	stop := wg.RunEveryJitter(interval, jitter, rand.New(rand.NewSource(42)), func() interface{} {
+		starts <- time.Now()
+		return nil
+	})
+	for i, d := range due {
+		elapsed := (<-starts).Sub(begin)
+		if elapsed < d || elapsed > d+time.Duration(i+1)*15*time.Millisecond {
+			t.Errorf("Run %d started after %v, expected %v", i, elapsed, d)
+		}
+	}
+	stop()
+}
+
+func TestAbortIf(t *testing.T) {
+	errFatal := errors.New("fatal error")
+	wg := new(worker.Group)
+	wg.AbortIf(func(err error) bool {
+		return err == errFatal
+	})
+	wg.Add(2, func(abort <-chan bool, data interface{}) error {
+		return errTest
+	})
+
+	in := wg.Start(nil)
+	if err := in.Wait(); err != nil {
+		t.Errorf("expected non-fatal errors to be ignored, got %v", err)
+	}
+	if len(in.Errors()) != 2 {
+		t.Errorf("expected non-fatal errors to be recorded, got %v", in.Errors())
+	}
+
+	wg.Add(1, func(abort <-chan bool, data interface{}) error {
+		return errFatal
+	})
+	if err := wg.Run(nil); err != errFatal {
+		t.Errorf("expected errFatal, got %v", err)
+	}
+}
+
+func TestWaitAllAny(t *testing.T) {
+	release := make(chan bool)
+	slow, fast := new(worker.Group), new(worker.Group)
+	slow.Add(1, func(abort <-chan bool, data interface{}) error {
+		<-release
+		return nil
+	})
+	fast.Add(1, func(abort <-chan bool, data interface{}) error {
+		return errTest
+	})
+
+	a, b := slow.Start(nil), fast.Start(nil)
+	if i, err := worker.WaitAny(a, nil, b); i != 2 || err != errTest {
+		t.Errorf("expected the fast Instance (2) with errTest, got %d and %v", i, err)
+	}
+	if i, err := worker.WaitAny(); i != -1 || err != nil {
+		t.Errorf("expected -1 and nil with no Instances, got %d and %v", i, err)
+	}
+
+	close(release)
+	errs := worker.WaitAll(a, nil, b)
+	if len(errs) != 3 || errs[0] != nil || errs[1] != nil || errs[2] != errTest {
+		t.Errorf("unexpected errors from WaitAll: %v", errs)
+	}
+}
+
+func TestAbortCause(t *testing.T) {
+	wg := new(worker.Group)
+	wg.Add(1, func(abort <-chan bool, data interface{}) error {
+		<-abort
+		return nil
+	})
+
+	in := wg.Start(nil)
+	in.Abort()
+	in.Wait()
+	if c := in.AbortCause(); c != worker.ExplicitAbort {
+		t.Errorf("expected ExplicitAbort, got %v", c)
+	}
+
+	wg.Add(1, func(abort <-chan bool, data interface{}) error {
+		return errTest
+	})
+	in, _ = wg.RunInstance(nil)
+	if c := in.AbortCause(); c != worker.WorkerError {
+		t.Errorf("expected WorkerError, got %v", c)
+	}
+}
+
+func TestGoroutineIDs(t *testing.T) {
+	wg := new(worker.Group)
+	wg.SetDebugGoroutineIDs(true)
+	wg.Add(2, func(abort <-chan bool, data interface{}) error {
+		return nil
+	})
+
+	in, _ := wg.RunInstance(nil)
+	ids := in.GoroutineIDs()
+	if len(ids) != 2 || ids[0] <= 0 || ids[1] <= 0 || ids[0] == ids[1] {
+		t.Errorf("unexpected goroutine IDs: %v", ids)
+	}
+}
+
+func TestAddStaggered(t *testing.T) {
+	var lock sync.Mutex
+	started := 0
+	wg := new(worker.Group)
+	wg.AddStaggered(3, time.Hour, func(abort <-chan bool, data interface{}) error {
+		lock.Lock()
+		started++
+		lock.Unlock()
+		<-abort
+		return nil
+	})
+
+	in := wg.Start(nil)
+	time.Sleep(10 * time.Millisecond)
+	in.AbortWait()
+	if started != 1 {
+		t.Errorf("expected only the first copy to start, got %d", started)
+	}
+}
+
+func TestCleanerTimeout(t *testing.T) {
+	release := make(chan bool)
+	defer close(release)
+
+	ran := false
+	wg := new(worker.Group)
+	wg.Add(1, func(abort <-chan bool, data interface{}) error {
+		return nil
+	})
+	wg.AddCleanerTimeout(10*time.Millisecond, func(data interface{}) {
+		<-release
+	})
+	wg.AddCleaner(func(data interface{}) {
+		ran = true
+	})
+
+	in := wg.Start(nil)
+	if err := in.Wait(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if !ran {
+		t.Error("Cleaner after the timed out one did not run")
+	}
+	errs := in.CleanupErrors()
+	if len(errs) != 1 {
+		t.Fatalf("expected 1 cleanup error, got %v", errs)
+	}
+	if _, ok := errs[0].(*worker.CleanerTimeoutError); !ok {
+		t.Errorf("expected a *CleanerTimeoutError, got %v", errs[0])
+	}
+}
+
+func TestRunWithBudget(t *testing.T) {
+	release := make(chan bool)
+	defer close(release)
+
+	// The Cleaner's timeout is set aside, so the Worker is aborted halfway through the budget.
+	var aborted time.Duration
+	start := time.Now()
+	wg := new(worker.Group)
+	wg.Add(1, func(abort <-chan bool, data interface{}) error {
+		<-abort
+		aborted = time.Since(start)
+		return nil
+	})
+	wg.AddCleanerTimeout(200*time.Millisecond, func(data interface{}) {})
+	if err := wg.RunWithBudget(nil, 400*time.Millisecond); err != worker.ErrTimeout {
+		t.Errorf("Expected ErrTimeout, got: %v", err)
+	}
+	if aborted < 150*time.Millisecond || aborted >= 400*time.Millisecond {
+		t.Errorf("Expected the Worker to be aborted after about 200ms, got: %v", aborted)
+	}
+
+	// A Worker that overruns leaves the Cleaners less time than their own timeouts, the stuck one is abandoned once the
+	// budget runs out rather than after its full 200ms.
+	start = time.Now()
+	wg = new(worker.Group)
+	wg.Add(1, func(abort <-chan bool, data interface{}) error {
+		<-abort
+		time.Sleep(150 * time.Millisecond)
+		return nil
+	})
+	wg.AddCleanerTimeout(200*time.Millisecond, func(data interface{}) {
+		<-release
+	})
+	if err := wg.RunWithBudget(nil, 400*time.Millisecond); err != worker.ErrTimeout {
+		t.Errorf("Expected ErrTimeout, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= 500*time.Millisecond {
+		t.Errorf("Expected the run to fit in the 400ms budget, took: %v", elapsed)
+	}
+}
+
+func TestState(t *testing.T) {
+	release, cleaning := make(chan bool), make(chan bool)
+	wg := new(worker.Group)
+	wg.Add(1, func(abort <-chan bool, data interface{}) error {
+		<-abort
+		<-release
+		return nil
+	})
+	wg.AddCleaner(func(data interface{}) {
+		cleaning <- true
+		<-release
+	})
+
+	in := wg.Start(nil)
+	if s := in.State(); s != worker.StateRunning {
+		t.Errorf("expected running, got %v", s)
+	}
+	in.Abort()
+	if s := in.State(); s != worker.StateAborting {
+		t.Errorf("expected aborting, got %v", s)
+	}
+	release <- true
+	<-cleaning
+	if s := in.State(); s != worker.StateCleaning {
+		t.Errorf("expected cleaning, got %v", s)
+	}
+	release <- true
+	in.Wait()
+	if s := in.State(); s != worker.StateDone {
+		t.Errorf("expected done, got %v", s)
+	}
+}
+
+func TestWaitWorker(t *testing.T) {
+	release := make(chan bool)
+	wg := new(worker.Group)
+	wg.Add(1, func(abort <-chan bool, data interface{}) error {
+		<-release
+		return nil
+	})
+	wg.AddCritical(1, func(abort <-chan bool, data interface{}) error {
+		return nil
+	})
+
+	in := wg.Start(nil)
+	if err := in.WaitWorker(1); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if in.Done() {
+		t.Error("WaitWorker waited for the whole Instance")
+	}
+	if err := in.WaitWorker(2); err != worker.ErrNoSuchWorker {
+		t.Errorf("expected ErrNoSuchWorker, got %v", err)
+	}
+	close(release)
+	in.Wait()
+}
+
+func TestAbortSignal(t *testing.T) {
+	started := make(chan bool)
+	wg := new(worker.Group)
+	wg.AddSignal(1, func(abort *worker.Abort, data interface{}) error {
+		if abort.IsSet() || abort.Level() != worker.NoAbort {
+			return errTest
+		}
+		started <- true
+		<-abort.Chan()
+		if !abort.IsSet() || abort.Level() != worker.HardAbort {
+			return errTest
+		}
+		return nil
+	})
+
+	in := wg.Start(nil)
+	<-started
+	if err := in.AbortWait(); err != worker.NonErrorAbort {
+		t.Errorf("expected NonErrorAbort, got %v", err)
+	}
+}
+
+func TestErrorWrapping(t *testing.T) {
+	wg := new(worker.Group)
+	wg.SetErrorWrapping(true)
+	wg.Add(1, func(abort <-chan bool, data interface{}) error {
+		return nil
+	})
+	wg.Add(1, func(abort <-chan bool, data interface{}) error {
+		return errTest
+	})
+
+	err := wg.Run(nil)
+	if !errors.Is(err, errTest) {
+		t.Errorf("wrapped error does not match errTest: %v", err)
+	}
+	if err == errTest || err.Error() != "Worker 1 (copy 0): "+errTest.Error() {
+		t.Errorf("error was not wrapped as expected: %v", err)
+	}
+}
+
+func TestFallback(t *testing.T) {
+	wg := new(worker.Group)
+	wg.Add(2, func(abort <-chan bool, data interface{}) error {
+		return errTest
+	})
+
+	var seen []error
+	wg.AddFallback(func(abort <-chan bool, data interface{}, errs []error) error {
+		seen = errs
+		return nil
+	})
+
+	in := wg.Start(nil)
+	if err := in.Wait(); err != nil {
+		t.Errorf("expected the fallback to recover the Instance, got %v", err)
+	}
+	if len(seen) != 2 {
+		t.Errorf("expected the fallback to see 2 errors, got %v", seen)
+	}
+}
+
+func TestMinRunDuration(t *testing.T) {
+	wg := new(worker.Group)
+	wg.SetMinRunDuration(time.Hour)
+	wg.Add(1, func(abort <-chan bool, data interface{}) error {
+		return errTest
+	})
+
+	r, _ := wg.Start(nil).WaitReport()
+	if !r.TooShort {
+		t.Error("a run that failed instantly was not flagged as too short")
+	}
+}
+
+func TestCheckpoints(t *testing.T) {
+	started := make(chan bool)
+	wg := new(worker.Group)
+	wg.AddResumable(1, func(abort <-chan bool, data interface{}, cp *worker.Checkpointer) error {
+		done, _ := cp.Last().(int)
+		if done == 0 {
+			cp.Save(5)
+			started <- true
+			<-abort
+			return nil
+		}
+		if done != 5 {
+			return errTest
+		}
+		return nil
+	})
+
+	first := wg.Start(nil)
+	<-started
+	first.Abort()
+	if err := wg.StartResume(first, nil).Wait(); err != nil {
+		t.Errorf("resumed run did not see the checkpoint: %v", err)
+	}
+}
+
+func TestEmit(t *testing.T) {
+	wg := new(worker.Group)
+	wg.AddEmitter(4, func(abort <-chan bool, data interface{}, emit *worker.Emitter) error {
+		seq := <-data.(chan int)
+		return emit.Emit(seq, seq*10)
+	})
+
+	ids := make(chan int, 4)
+	for _, seq := range []int{3, 0, 2, 1} {
+		ids <- seq
+	}
+
+	in := wg.Start(ids)
+	if err := in.Wait(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	results := in.EmittedResults()
+	if len(results) != 4 {
+		t.Fatalf("Expected 4 results, got %d", len(results))
+	}
+	for i, r := range results {
+		if r.(int) != i*10 {
+			t.Errorf("Result %d out of order: %v", i, r)
+		}
+	}
+
+	var dup *worker.DuplicateSequenceError
+	if !errors.As(in.Emit(2, nil), &dup) || dup.Seq != 2 {
+		t.Errorf("Expected a DuplicateSequenceError for sequence 2.")
+	}
+}
+
+func TestAbortOnFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stop")
+
+	wg := new(worker.Group)
+	wg.Add(1, func(abort <-chan bool, data interface{}) error {
+		<-abort
+		return nil
+	})
+
+	in := wg.Start(nil)
+	stop := in.AbortOnFile(path, time.Millisecond)
+	defer stop()
+
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := in.Wait(); !worker.IsAbort(err) {
+		t.Errorf("Expected an abort, got: %v", err)
+	}
+	if in.AbortCause() != worker.ExplicitAbort {
+		t.Errorf("Unexpected abort cause: %v", in.AbortCause())
+	}
+
+	// A bad interval must not panic in the polling goroutine, it just turns the watch off.
+	wg = new(worker.Group)
+	wg.Add(1, func(abort <-chan bool, data interface{}) error { return nil })
+	in = wg.Start(nil)
+	in.AbortOnFile(path, 0)()
+	in.AbortOnFile(path, -time.Second)()
+	if err := in.Wait(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestSlowestWorker(t *testing.T) {
+	r := worker.RunReport{Workers: []worker.WorkerReport{
+		{Index: 0, Duration: time.Second},
+		{Index: 1, Duration: 2 * time.Second},
+		{Index: 2, Duration: 2 * time.Second},
+	}}
+	if id, w := r.SlowestWorker(); id != 1 || w.Index != 1 {
+		t.Errorf("Wrong slowest Worker: %d %+v", id, w)
+	}
+
+	if id, _ := (worker.RunReport{}).SlowestWorker(); id != -1 {
+		t.Errorf("Expected -1 for an empty report, got %d", id)
+	}
+}
+
+func TestTags(t *testing.T) {
+	wg := new(worker.Group)
+	release := make(chan bool)
+	wg.Add(1, func(abort <-chan bool, data interface{}) error {
+		<-release
+		return nil
+	})
+
+	in := wg.Start(nil)
+	in.SetTag("request", "abc")
+	in.SetTag("user", "1")
+	in.SetTag("user", "2")
+
+	tags := in.Tags()
+	tags["request"] = "changed"
+	close(release)
+
+	r := in.Report()
+	if len(r.Tags) != 2 || r.Tags["request"] != "abc" || r.Tags["user"] != "2" {
+		t.Errorf("Unexpected tags in report: %v", r.Tags)
+	}
+}
+
+func TestWaitStarted(t *testing.T) {
+	var lock sync.Mutex
+	entered := 0
+
+	wg := new(worker.Group)
+	wg.Add(3, func(abort <-chan bool, data interface{}) error {
+		<-abort
+		return nil
+	})
+	wg.OnWorkerStart(func(id int) {
+		time.Sleep(10 * time.Millisecond)
+		lock.Lock()
+		entered++
+		lock.Unlock()
+	})
+
+	in := wg.Start(nil)
+	in.WaitStarted()
+
+	lock.Lock()
+	if entered != 3 {
+		t.Errorf("Expected 3 Workers to have started, got %d", entered)
+	}
+	lock.Unlock()
+
+	in.Abort()
+	in.Wait()
+}
+
+func TestRand(t *testing.T) {
+	wg := new(worker.Group)
+	wg.Add(4, func(abort <-chan bool, data interface{}) error {
+		<-abort
+		return nil
+	})
+	wg.SetRandSeed(42)
+
+	draw := func() []int64 {
+		in := wg.Start(nil)
+		defer in.Close()
+
+		// Hammer it from several goroutines to make sure the race detector is happy.
+		var wait sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wait.Add(1)
+			go func() {
+				defer wait.Done()
+				for j := 0; j < 100; j++ {
+					in.Rand().Intn(10)
+				}
+			}()
+		}
+		wait.Wait()
+
+		return []int64{in.Rand().Int63(), in.Rand().Int63()}
+	}
+
+	a, b := draw(), draw()
+	if a[0] != b[0] || a[1] != b[1] {
+		t.Errorf("Same seed gave different values: %v %v", a, b)
+	}
+}
+
+func TestRunError(t *testing.T) {
+	wg := new(worker.Group)
+	wg.Add(1, func(abort <-chan bool, data interface{}) error { return errTest })
+	wg.Add(1, func(abort <-chan bool, data interface{}) error {
+		<-abort
+		return nil
+	})
+	wg.SetRunErrors(true)
+
+	err := wg.Run(nil)
+	var re *worker.RunError
+	if !errors.As(err, &re) {
+		t.Fatalf("Expected a *RunError, got: %#v", err)
+	}
+	if !errors.Is(err, errTest) || !re.Aborted() || re.Cause() != worker.WorkerError || re.TimedOut() {
+		t.Errorf("Unexpected RunError details: %v %v %v", re, re.Cause(), re.TimedOut())
+	}
+	if errs := re.WorkerErrors(); len(errs) != 1 || errs[0] != errTest {
+		t.Errorf("Unexpected Worker errors: %v", errs)
+	}
+
+	wg = new(worker.Group)
+	wg.SetRunErrors(true)
+	wg.Add(1, func(abort <-chan bool, data interface{}) error {
+		<-abort
+		return nil
+	})
+	in := wg.Start(nil)
+	in.Abort()
+	if err := in.Wait(); !worker.IsAbort(err) || !errors.As(err, &re) || re.Cause() != worker.ExplicitAbort {
+		t.Errorf("Expected a RunError wrapping NonErrorAbort, got: %v", err)
+	}
+}
+
+func TestAddFinalizer(t *testing.T) {
+	var lock sync.Mutex
+	order := []string{}
+	log := func(s string) {
+		lock.Lock()
+		order = append(order, s)
+		lock.Unlock()
+	}
+
+	wg := new(worker.Group)
+	wg.Add(2, func(abort <-chan bool, data interface{}) error {
+		log("worker")
+		return nil
+	})
+	wg.AddFinalizer(func(abort <-chan bool, data interface{}) error {
+		log("finalizer")
+		return errTest
+	})
+	wg.AddCleaner(func(data interface{}) { log("cleaner") })
+
+	in := wg.Start(nil)
+	if err := in.Wait(); err != errTest {
+		t.Errorf("Expected the Finalizer's error, got: %v", err)
+	}
+	if len(order) != 4 || order[2] != "finalizer" || order[3] != "cleaner" {
+		t.Errorf("Unexpected lifecycle order: %v", order)
+	}
+	if in.ErrorCount() != 1 {
+		t.Errorf("Expected 1 recorded error, got %d", in.ErrorCount())
+	}
+}
+
+func TestStragglerGrace(t *testing.T) {
+	release := make(chan bool)
+	defer close(release)
+
+	wg := new(worker.Group)
+	wg.Add(1, func(abort <-chan bool, data interface{}) error {
+		<-release
+		return nil
+	})
+	wg.Add(1, func(abort <-chan bool, data interface{}) error {
+		<-abort
+		return nil
+	})
+	wg.SetStragglerGrace(10 * time.Millisecond)
+
+	in := wg.Start(nil)
+	in.Abort()
+
+	r, err := in.WaitReport()
+	if !worker.IsAbort(err) {
+		t.Errorf("Expected NonErrorAbort, got: %v", err)
+	}
+	if !r.Workers[0].Abandoned || r.Workers[0].Err != worker.ErrAbandoned || r.Workers[1].Abandoned {
+		t.Errorf("Unexpected report: %+v", r.Workers)
+	}
+	if err := in.WaitWorker(0); err != worker.ErrAbandoned {
+		t.Errorf("Expected ErrAbandoned from WaitWorker, got: %v", err)
+	}
+}
+
+func TestErrorPolicy(t *testing.T) {
+	errFatal := errors.New("fatal error")
+	policy := worker.AnyOf(
+		worker.PredicatePolicy(func(err error) bool { return err == errFatal }),
+		worker.ThresholdPolicy(3),
+	)
+
+	run := func(errs ...error) error {
+		wg := new(worker.Group)
+		wg.SetErrorPolicy(policy)
+		for _, err := range errs {
+			err := err
+			wg.Add(1, func(abort <-chan bool, data interface{}) error { return err })
+		}
+		return wg.Run(nil)
+	}
+
+	if err := run(errTest, errTest, nil); err != nil {
+		t.Errorf("Two errors should be tolerated, got: %v", err)
+	}
+	if err := run(errTest, errTest, errTest); err != errTest {
+		t.Errorf("Three errors should abort, got: %v", err)
+	}
+	if err := run(errFatal, nil); err != errFatal {
+		t.Errorf("A fatal error should abort, got: %v", err)
+	}
+
+	if worker.AllOf(worker.FirstErrorPolicy(), worker.ThresholdPolicy(2)).Abort(errTest, 1) {
+		t.Errorf("AllOf should require every policy to agree.")
+	}
+}
+
+func TestOnNeverWaited(t *testing.T) {
+	dropped := make(chan worker.RunReport, 2)
+
+	wg := new(worker.Group)
+	wg.Add(1, func(abort <-chan bool, data interface{}) error { return errTest })
+	wg.OnNeverWaited(func(r worker.RunReport) { dropped <- r })
+
+	// One that is waited for, and one that is forgotten.
+	wg.Start(nil).Wait()
+	done := make(chan bool)
+	wg.Start(nil).OnDone(func(err error) { close(done) })
+	<-done
+	func() {
+		in := wg.Start(nil)
+		in.SetTag("name", "forgotten")
+		in.WaitStarted()
+	}()
+
+	deadline := time.After(5 * time.Second)
+	for {
+		runtime.GC()
+		select {
+		case r := <-dropped:
+			if r.Tags["name"] != "forgotten" || r.Workers[0].Err != errTest {
+				t.Errorf("Hook called for the wrong Instance: %+v", r)
+			}
+			return
+		case <-deadline:
+			t.Fatal("Hook was never called for the forgotten Instance.")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestOnNeverWaitedResults(t *testing.T) {
+	dropped := make(chan worker.RunReport, 2)
+
+	wg := new(worker.Group)
+	wg.AddCollector(1, func(abort <-chan bool, data interface{}) (interface{}, error) { return 1, nil })
+	wg.OnNeverWaited(func(r worker.RunReport) { dropped <- r })
+
+	// Asking for the results is as good as waiting, whether directly or through MergeResults.
+	func() {
+		wg.Start(nil).Results()
+		worker.MergeResults[int](wg.Start(nil))
+	}()
+
+	for i := 0; i < 10; i++ {
+		runtime.GC()
+		select {
+		case r := <-dropped:
+			t.Fatalf("Hook called for an Instance whose results were read: %+v", r)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestRunSync(t *testing.T) {
+	order := []int{}
+	wg := new(worker.Group)
+	wg.Add(1, func(abort <-chan bool, data interface{}) error {
+		order = append(order, 0)
+		return errTest
+	})
+	wg.Add(1, func(abort <-chan bool, data interface{}) error {
+		select {
+		case <-abort:
+			order = append(order, 1)
+		default:
+			t.Error("The second Worker should see the abort.")
+		}
+		return nil
+	})
+	wg.AddCleaner(func(data interface{}) { order = append(order, 2) })
+
+	if err := wg.RunSync(nil); err != errTest {
+		t.Errorf("Expected errTest, got: %v", err)
+	}
+	if len(order) != 3 || order[0] != 0 || order[1] != 1 || order[2] != 2 {
+		t.Errorf("Unexpected order: %v", order)
+	}
+
+	wg.Add(2, func(abort <-chan bool, data interface{}) error { return nil })
+	if err := wg.RunSync(nil); err == nil {
+		t.Error("Expected an error for a count of two.")
+	}
+}
+
+func TestTimeline(t *testing.T) {
+	wg := new(worker.Group)
+	wg.Add(1, func(abort <-chan bool, data interface{}) error { return errTest })
+	wg.AddCleaner(func(data interface{}) {})
+	wg.SetRecordTimeline(true)
+
+	in := wg.Start(nil)
+	in.Wait()
+
+	expected := []worker.EventKind{
+		worker.WorkerStarted,
+		worker.WorkerFinished,
+		worker.AbortOrdered,
+		worker.CleanerStarted,
+		worker.CleanerFinished,
+		worker.InstanceDone,
+	}
+	events := in.Timeline()
+	if len(events) != len(expected) {
+		t.Fatalf("Unexpected timeline: %v", events)
+	}
+	for i, e := range events {
+		if e.Kind != expected[i] {
+			t.Errorf("Event %d: expected %v, got %v", i, expected[i], e.Kind)
+		}
+		if i > 0 && e.Time.Before(events[i-1].Time) {
+			t.Errorf("Event %d is out of order.", i)
+		}
+	}
+	if events[2].Cause != worker.WorkerError || events[2].Err != errTest {
+		t.Errorf("Unexpected abort event: %+v", events[2])
+	}
+
+	if new(worker.Group).Start(nil).Timeline() != nil {
+		t.Error("Expected no timeline when recording is off.")
+	}
+}
+
+func TestAddWithTransform(t *testing.T) {
+	items := []int{1, 2, 3, 4, 5, 6}
+	var lock sync.Mutex
+	sum := 0
+
+	wg := new(worker.Group)
+	wg.AddWithTransform(3, func(data interface{}, copy int) interface{} {
+		all := data.([]int)
+		return all[copy*2 : copy*2+2]
+	}, func(abort <-chan bool, data interface{}) error {
+		shard := data.([]int)
+		if len(shard) != 2 {
+			return fmt.Errorf("Unexpected shard: %v", shard)
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+		for _, v := range shard {
+			sum += v
+		}
+		return nil
+	})
+
+	if err := wg.Run(items); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if sum != 21 {
+		t.Errorf("Expected every item to be seen once, sum is %d", sum)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	var lock sync.Mutex
+	healthy := true
+
+	wg := new(worker.Group)
+	wg.Add(2, func(abort <-chan bool, data interface{}) error {
+		<-abort
+		return nil
+	})
+	wg.SetHealthCheck(time.Millisecond, func(data interface{}) error {
+		lock.Lock()
+		defer lock.Unlock()
+		if !healthy {
+			return errTest
+		}
+		return nil
+	})
+
+	in := wg.Start(nil)
+	time.Sleep(5 * time.Millisecond)
+	if in.State() != worker.StateRunning {
+		t.Fatalf("A healthy Instance should keep running, it is %v", in.State())
+	}
+
+	lock.Lock()
+	healthy = false
+	lock.Unlock()
+
+	if err := in.Wait(); err != errTest {
+		t.Errorf("Expected the health check error, got: %v", err)
+	}
+	if in.AbortCause() != worker.HealthCheckFailed || in.AbortCausingError() != errTest || in.ErrorCount() != 0 {
+		t.Errorf("Unexpected abort details: %v %v %d", in.AbortCause(), in.AbortCausingError(), in.ErrorCount())
+	}
+}
+
+func TestAddNode(t *testing.T) {
+	var lock sync.Mutex
+	ran := map[string]bool{}
+	node := func(name string, err error) worker.Worker {
+		return func(abort <-chan bool, data interface{}) error {
+			lock.Lock()
+			ran[name] = true
+			lock.Unlock()
+			return err
+		}
+	}
+
+	// Dependencies are declared before they are added on purpose.
+	wg := new(worker.Group)
+	wg.AddNode("c", []string{"a", "b"}, node("c", nil))
+	wg.AddNode("a", nil, node("a", nil))
+	wg.AddNode("b", []string{"a"}, node("b", nil))
+
+	r, err := wg.Start(nil).WaitReport()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(r.NodeOrder) != 3 || r.NodeOrder[0] != "a" || r.NodeOrder[1] != "b" || r.NodeOrder[2] != "c" {
+		t.Errorf("Unexpected node order: %v", r.NodeOrder)
+	}
+
+	ran = map[string]bool{}
+	wg = new(worker.Group)
+	wg.SetErrorThreshold(10)
+	wg.AddNode("a", nil, node("a", errTest))
+	wg.AddNode("b", []string{"a"}, node("b", nil))
+	wg.AddNode("c", []string{"b"}, node("c", nil))
+
+	in := wg.Start(nil)
+	in.WaitDrain()
+	var dep *worker.DependencyError
+	if err := in.WaitWorker(2); !errors.As(err, &dep) || dep.Node != "c" || !errors.Is(err, errTest) {
+		t.Errorf("Expected a DependencyError for c, got: %v", err)
+	}
+	if ran["b"] || ran["c"] {
+		t.Errorf("Dependents of a failed node should not run: %v", ran)
+	}
+
+	wg = new(worker.Group)
+	wg.AddNode("a", []string{"b"}, node("a", nil))
+	wg.AddNode("b", []string{"a"}, node("b", nil))
+	if wg.Validate() == nil {
+		t.Error("Validate should report the cycle.")
+	}
+	if err := wg.Run(nil); err == nil {
+		t.Error("Starting a Group with a cycle should fail rather than deadlock.")
+	}
+}
+
+func TestStartContext(t *testing.T) {
+	wait := func(ctx context.Context, data interface{}) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	wg := new(worker.Group)
+	wg.AddContext(2, wait)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	in := wg.StartContext(ctx, nil)
+	cancel()
+	if err := in.Wait(); err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got: %v", err)
+	}
+	if in.AbortCause() != worker.ContextCanceled || in.ErrorCount() != 0 {
+		t.Errorf("Unexpected abort details: %v, %d errors", in.AbortCause(), in.ErrorCount())
+	}
+}
+
+func TestContextErrors(t *testing.T) {
+	wait := func(ctx context.Context, data interface{}) error {
+		<-ctx.Done()
+		return fmt.Errorf("wrapped: %w", ctx.Err())
+	}
+
+	// An explicit abort is still a NonErrorAbort, even though the Workers return the context error.
+	wg := new(worker.Group)
+	wg.AddContext(2, wait)
+	in := wg.Start(nil)
+	in.Abort()
+	if err := in.Wait(); !worker.IsAbort(err) || in.ErrorCount() != 0 {
+		t.Errorf("Expected NonErrorAbort and no errors, got: %v, %d errors", err, in.ErrorCount())
+	}
+
+	// Nor do they hide the Worker error that caused the abort.
+	wg.Add(1, func(abort <-chan bool, data interface{}) error { return errTest })
+	if err := wg.Run(nil); err != errTest {
+		t.Errorf("Expected errTest, got: %v", err)
+	}
+
+	// A context error from before the Instance's context was canceled is a real error.
+	wg = new(worker.Group)
+	wg.AddContext(1, func(ctx context.Context, data interface{}) error { return context.DeadlineExceeded })
+	if err := wg.Run(nil); err != context.DeadlineExceeded {
+		t.Errorf("Expected context.DeadlineExceeded, got: %v", err)
+	}
+
+	wg = new(worker.Group)
+	wg.SetContextErrorsFatal(true)
+	wg.AddContext(2, wait)
+	in = wg.Start(nil)
+	in.Abort()
+	if err := in.Wait(); !errors.Is(err, context.Canceled) || in.ErrorCount() != 2 {
+		t.Errorf("Expected the context errors to be recorded, got: %v, %d errors", err, in.ErrorCount())
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	release := make(chan bool)
+	seen := make(chan time.Time, 1)
+	wg := new(worker.Group)
+	wg.AddContext(1, func(ctx context.Context, data interface{}) error {
+		deadline, _ := ctx.Deadline()
+		seen <- deadline
+		<-release
+		return nil
+	})
+
+	in := wg.Start(nil)
+	if _, ok := in.Deadline(); ok {
+		t.Error("Expected no deadline without a parent context.")
+	}
+	release <- true
+	in.Wait()
+	<-seen
+
+	deadline := time.Now().Add(time.Hour)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	in = wg.StartContext(ctx, nil)
+	if got, ok := in.Deadline(); !ok || !got.Equal(deadline) {
+		t.Errorf("Expected the parent's deadline, got: %v, %v", got, ok)
+	}
+	release <- true
+	in.Wait()
+	if got := <-seen; !got.Equal(deadline) {
+		t.Errorf("Expected the Worker to see the parent's deadline, got: %v", got)
+	}
+}
+
+func TestContextCause(t *testing.T) {
+	errReason := errors.New("reason")
+	errParent := errors.New("parent cause")
+
+	// run starts an Instance whose ContextWorker reports the cause it saw, kill aborts it somehow.
+	run := func(start func(wg *worker.Group) *worker.Instance, kill func(in *worker.Instance)) error {
+		wg := new(worker.Group)
+		cause := make(chan error, 1)
+		wg.AddContext(1, func(ctx context.Context, data interface{}) error {
+			<-ctx.Done()
+			cause <- context.Cause(ctx)
+			return nil
+		})
+		in := start(wg)
+		kill(in)
+		in.Wait()
+		return <-cause
+	}
+	start := func(wg *worker.Group) *worker.Instance { return wg.Start(nil) }
+
+	if cause := run(start, (*worker.Instance).Abort); cause != worker.NonErrorAbort {
+		t.Errorf("Expected NonErrorAbort for an explicit abort, got: %v", cause)
+	}
+	if cause := run(start, func(in *worker.Instance) { in.AbortWith(errReason) }); cause != errReason {
+		t.Errorf("Expected the AbortWith reason, got: %v", cause)
+	}
+	fail := func(in *worker.Instance) {
+		in.Add(1, func(abort <-chan bool, data interface{}) error { return errTest })
+	}
+	if cause := run(start, fail); cause != errTest {
+		t.Errorf("Expected the Worker error, got: %v", cause)
+	}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cause := run(func(wg *worker.Group) *worker.Instance { return wg.StartContext(ctx, nil) },
+		func(in *worker.Instance) { cancel(errParent) })
+	if cause != errParent {
+		t.Errorf("Expected the parent's cause, got: %v", cause)
+	}
+
+	cause = run(func(wg *worker.Group) *worker.Instance { return wg.StartWithTimeout(nil, time.Millisecond) },
+		func(in *worker.Instance) {})
+	if !worker.IsTimeout(cause) {
+		t.Errorf("Expected a timeout, got: %v", cause)
+	}
+}
+
+func TestJoinErrors(t *testing.T) {
+	errOther := errors.New("other error")
+
+	wg := new(worker.Group)
+	wg.SetJoinErrors(true)
+	release := make(chan bool)
+	wg.Add(1, func(abort <-chan bool, data interface{}) error {
+		close(release)
+		return errTest
+	})
+	wg.Add(1, func(abort <-chan bool, data interface{}) error {
+		<-release
+		<-abort
+		return errOther
+	})
+
+	in := wg.Start(nil)
+	err := in.Wait()
+	if !errors.Is(err, errTest) || !errors.Is(err, errOther) {
+		t.Errorf("Expected both errors, got: %v", err)
+	}
+	if errs := in.Errors(); len(errs) != 2 || errs[0] != errTest || errs[1] != errOther {
+		t.Errorf("Unexpected Errors: %v", errs)
+	}
+
+	wg = new(worker.Group)
+	wg.SetJoinErrors(true)
+	wg.Add(1, func(abort <-chan bool, data interface{}) error { return errTest })
+	if err := wg.Run(nil); err != errTest {
+		t.Errorf("A single error should not be joined, got: %v", err)
+	}
+}
+
+func TestRecoverPanics(t *testing.T) {
+	cleaned := false
+
+	wg := new(worker.Group)
+	wg.SetRecoverPanics(true)
+	wg.Add(1, func(abort <-chan bool, data interface{}) error {
+		var m map[string]int
+		m["boom"] = 1
+		return nil
+	})
+	wg.Add(1, func(abort <-chan bool, data interface{}) error {
+		<-abort
+		return nil
+	})
+	wg.AddCleaner(func(data interface{}) { cleaned = true })
+
+	err := wg.Run(nil)
+	var pe *worker.PanicError
+	if !errors.As(err, &pe) || len(pe.Stack) == 0 {
+		t.Errorf("Expected a PanicError, got: %v", err)
+	}
+	if !cleaned {
+		t.Error("Cleaners did not run after a panic.")
+	}
+
+	other := new(worker.Group)
+	other.SetRecoverPanics(true)
+	other.Add(1, func(abort <-chan bool, data interface{}) error { panic(errTest) })
+	if err := other.Run(nil); !errors.Is(err, errTest) {
+		t.Errorf("Expected the panic value to be unwrapped, got: %v", err)
+	}
+}
+
+func TestAddCollector(t *testing.T) {
+	jobs := make(chan int, 5)
+	for i := 1; i <= 5; i++ {
+		jobs <- i
+	}
+	close(jobs)
+
+	wg := new(worker.Group)
+	wg.SetErrorThreshold(10)
+	wg.AddCollector(5, func(abort <-chan bool, data interface{}) (interface{}, error) {
+		i := <-data.(chan int)
+		if i == 3 {
+			return i, errTest
+		}
+		return i * i, nil
+	})
+
+	in := wg.Start(jobs)
+	in.Wait()
+
+	sum := 0
+	results := in.Results()
+	for _, r := range results {
+		sum += r.(int)
+	}
+	if len(results) != 4 || sum != 1+4+16+25 {
+		t.Errorf("Unexpected results: %v", results)
+	}
+}
+
+func TestCollectorAbort(t *testing.T) {
+	// Copy 0 fails once the others have their results, so they only return them after seeing the abort.
+	var ready sync.WaitGroup
+	ready.Add(2)
+	wg := new(worker.Group)
+	wg.AddCollector(3, func(abort <-chan bool, data interface{}) (interface{}, error) {
+		job := <-data.(chan int)
+		if job == 0 {
+			ready.Wait()
+			return nil, errTest
+		}
+
+		result := job * 10
+		ready.Done()
+		<-abort
+		return result, nil
+	})
+
+	jobs := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		jobs <- i
+	}
+	in := wg.Start(jobs)
+	if err := in.Wait(); err != errTest {
+		t.Errorf("Expected errTest, got: %v", err)
+	}
+
+	sum := 0
+	results := in.Results()
+	for _, r := range results {
+		sum += r.(int)
+	}
+	if len(results) != 2 || sum != 10+20 {
+		t.Errorf("Expected the results finished before the abort, got: %v", results)
+	}
+}
+
+func TestResultBufferPolicy(t *testing.T) {
+	value := func(abort <-chan bool, data interface{}) (interface{}, error) { return 1, nil }
+
+	// The sink is stuck on the first result until every other one has been collected, so all but the newest 2 of
+	// those are dropped.
+	first, start, release := make(chan bool), make(chan bool), make(chan bool)
+	sunk := 0
+	wg := new(worker.Group)
+	wg.SetResultBufferPolicy(2, worker.DropOldest)
+	wg.AddCollector(1, value)
+	wg.AddCollector(9, func(abort <-chan bool, data interface{}) (interface{}, error) {
+		<-start
+		return 1, nil
+	})
+	wg.SetResultSink(func(result interface{}) {
+		if sunk == 0 {
+			first <- true
+			<-release
+		}
+		sunk++
+	})
+
+	in := wg.Start(nil)
+	<-first
+	close(start)
+	for in.Completed() < 10 {
+		time.Sleep(time.Millisecond)
+	}
+	if in.Running() != 0 {
+		t.Errorf("Expected every Worker to have returned while the sink was stuck, %d still running", in.Running())
+	}
+	close(release)
+	if err := in.Wait(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if sunk != 3 || in.DroppedResults() != 7 {
+		t.Errorf("Expected 3 results to reach the sink and 7 to be dropped, got %d and %d", sunk, in.DroppedResults())
+	}
+
+	// Blocking loses nothing.
+	sunk = 0
+	wg = new(worker.Group)
+	wg.SetResultBufferPolicy(1, worker.BlockWhenFull)
+	wg.AddCollector(5, value)
+	wg.SetResultSink(func(result interface{}) {
+		time.Sleep(time.Millisecond)
+		sunk++
+	})
+	in = wg.Start(nil)
+	if err := in.Wait(); err != nil || sunk != 5 || in.DroppedResults() != 0 {
+		t.Errorf("Expected all 5 results, got %d (%d dropped, error: %v)", sunk, in.DroppedResults(), err)
+	}
+
+	// Without a sink the collected results are bounded instead.
+	wg = new(worker.Group)
+	wg.SetResultBufferPolicy(2, worker.DropOldest)
+	wg.AddCollector(5, value)
+	in = wg.Start(nil)
+	if results := in.Results(); len(results) != 2 || in.DroppedResults() != 3 {
+		t.Errorf("Expected 2 results with 3 dropped, got %v (%d dropped)", results, in.DroppedResults())
+	}
+}
+
+func TestResultDefault(t *testing.T) {
+	wg := new(worker.Group)
+	wg.SetResultDefault(10*time.Millisecond, 0)
+	wg.AddCollector(2, func(abort <-chan bool, data interface{}) (interface{}, error) { return 1, nil })
+	wg.AddCollector(1, func(abort <-chan bool, data interface{}) (interface{}, error) {
+		<-abort
+		return 100, errTest
+	})
+
+	in := wg.Start(nil)
+	if err := in.Wait(); err != nil {
+		t.Errorf("Expected the late Worker's error to be replaced, got: %v", err)
+	}
+	sum := 0
+	for _, r := range in.Results() {
+		sum += r.(int)
+	}
+	if len(in.Results()) != 3 || sum != 2 {
+		t.Errorf("Expected the default for the late Worker, got: %v", in.Results())
+	}
+
+	// An Instance abort before the deadline is not a late result.
+	wg = new(worker.Group)
+	wg.SetResultDefault(time.Hour, 0)
+	wg.AddCollector(1, func(abort <-chan bool, data interface{}) (interface{}, error) {
+		<-abort
+		return 5, nil
+	})
+	in = wg.Start(nil)
+	in.Abort()
+	if results := in.Results(); len(results) != 1 || results[0] != 5 {
+		t.Errorf("Expected the Worker's own result, got: %v", results)
+	}
+}
+
+func TestResultCleaner(t *testing.T) {
+	var order []string
+	var got []interface{}
+	wg := new(worker.Group)
+	wg.AddCollector(3, func(abort <-chan bool, data interface{}) (interface{}, error) { return 1, nil })
+	wg.AddCleaner(func(data interface{}) { order = append(order, "before") })
+	wg.AddResultCleaner(func(data interface{}, results []interface{}) {
+		order = append(order, "results")
+		got = results
+	})
+	wg.AddCleaner(func(data interface{}) { order = append(order, "after") })
+
+	if err := wg.Run(nil); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(got) != 3 {
+		t.Errorf("Expected all 3 results in the Cleaner, got: %v", got)
+	}
+	if strings.Join(order, " ") != "before results after" {
+		t.Errorf("Cleaners ran out of order: %v", order)
+	}
+
+	wg = new(worker.Group)
+	wg.AddResultCleaner(nil)
+	if err := wg.Validate(); err == nil {
+		t.Error("Expected Validate to report a nil ResultCleaner.")
+	}
+}
+
+type failEncoder struct{ worker.GobEncoder }
+
+func (failEncoder) Encode(w io.Writer, v interface{}) error {
+	return errTest
+}
+
+func TestResultSpill(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("TMPDIR", dir)
+
+	jobs := make(chan int, 10)
+	for i := 0; i < 10; i++ {
+		jobs <- i
+	}
+	spilled := 0
+	sum := 0
+	wg := new(worker.Group)
+	wg.AddCollector(10, func(abort <-chan bool, data interface{}) (interface{}, error) {
+		return <-jobs, nil
+	})
+	wg.SetResultSpill(3, nil)
+	wg.AddIteratorCleaner(func(data interface{}, results *worker.ResultIterator) {
+		files, _ := os.ReadDir(dir)
+		spilled = len(files)
+		for results.Next() {
+			sum += results.Value().(int)
+		}
+		if err := results.Err(); err != nil {
+			t.Errorf("Unexpected error reading the results: %v", err)
+		}
+	})
+
+	in := wg.Start(nil)
+	if err := in.Wait(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if n := len(in.Results()); n != 3 {
+		t.Errorf("Expected 3 results in memory, got: %v", n)
+	}
+	if spilled != 1 || sum != 45 {
+		t.Errorf("Expected every result through one spill file, got %v files and a sum of %v", spilled, sum)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Errorf("Expected the spill file to be removed, got: %v", files)
+	}
+
+	// A result that can't be spilled is an error like any other.
+	wg = new(worker.Group)
+	wg.AddCollector(2, func(abort <-chan bool, data interface{}) (interface{}, error) { return 1, nil })
+	wg.SetResultSpill(1, failEncoder{})
+	if err := wg.Run(nil); err != errTest {
+		t.Errorf("Expected the encoder's error, got: %v", err)
+	}
+
+	wg = new(worker.Group)
+	wg.AddIteratorCleaner(nil)
+	if err := wg.Validate(); err == nil {
+		t.Error("Expected Validate to report a nil IteratorCleaner.")
+	}
+}
+
+func TestResultValidator(t *testing.T) {
+	errOdd := errors.New("odd result")
+
+	wg := new(worker.Group)
+	jobs := make(chan int, 4)
+	for i := 1; i <= 4; i++ {
+		jobs <- i
+	}
+	wg.AddCollector(4, func(abort <-chan bool, data interface{}) (interface{}, error) {
+		return <-data.(chan int), nil
+	})
+	wg.SetResultValidator(func(result interface{}) error {
+		if result.(int)%2 == 1 {
+			return errOdd
+		}
+		return nil
+	})
+
+	in := wg.Start(jobs)
+	if err := in.Wait(); err != errOdd {
+		t.Errorf("Expected errOdd, got: %v", err)
+	}
+	if in.ErrorCount() != 2 {
+		t.Errorf("Expected the 2 rejected results to count as errors, got %d", in.ErrorCount())
+	}
+	sum := 0
+	for _, r := range in.Results() {
+		sum += r.(int)
+	}
+	if len(in.Results()) != 2 || sum != 2+4 {
+		t.Errorf("Expected only the even results, got: %v", in.Results())
+	}
+}
+
+func TestResultSink(t *testing.T) {
+	// square collects the square of the job its copy takes.
+	square := func(abort <-chan bool, data interface{}) (interface{}, error) {
+		i := <-data.(chan int)
+		return i * i, nil
+	}
+	jobs := func(n int) chan int {
+		ch := make(chan int, n)
+		for i := 1; i <= n; i++ {
+			ch <- i
+		}
+		close(ch)
+		return ch
+	}
+
+	// The sink is called serially, so it doesn't lock anything.
+	var sunk []interface{}
+	sum := 0
+	wg := new(worker.Group)
+	wg.AddCollector(5, square)
+	wg.SetResultSink(func(result interface{}) {
+		sunk = append(sunk, result)
+		sum += result.(int)
+	})
+
+	in := wg.Start(jobs(5))
+	if err := in.Wait(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(sunk) != 5 || sum != 1+4+9+16+25 {
+		t.Errorf("Unexpected sink results: %v", sunk)
+	}
+	if results := in.Results(); len(results) != 0 {
+		t.Errorf("Expected no collected results with a sink, got: %v", results)
+	}
+}
+
+func TestRunWithTimeout(t *testing.T) {
+	wg := new(worker.Group)
+	wg.Add(2, func(abort <-chan bool, data interface{}) error {
+		<-abort
+		return nil
+	})
+
+	in := wg.StartWithTimeout(nil, 10*time.Millisecond)
+	if err := in.Wait(); err != worker.ErrTimeout {
+		t.Errorf("Expected ErrTimeout, got: %v", err)
+	}
+	if in.AbortCause() != worker.TimedOut {
+		t.Errorf("Unexpected abort cause: %v", in.AbortCause())
+	}
+
+	wg = new(worker.Group)
+	wg.Add(1, func(abort <-chan bool, data interface{}) error { return nil })
+	workergrouptest.AssertNoLeaks(t, func() {
+		if err := wg.RunWithTimeout(nil, time.Hour); err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	wg = new(worker.Group)
+	wg.Add(1, func(abort <-chan bool, data interface{}) error { return errTest })
+	if err := wg.RunWithTimeout(nil, time.Hour); err != errTest {
+		t.Errorf("Expected errTest, got: %v", err)
+	}
+}
+
+func TestTimeoutDeadline(t *testing.T) {
+	wg := new(worker.Group)
+	wg.AddContext(1, func(ctx context.Context, data interface{}) error {
+		if _, ok := ctx.Deadline(); !ok {
+			t.Error("Expected the Worker's context to have a deadline.")
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	start := time.Now()
+	in := wg.StartWithTimeout(nil, 10*time.Millisecond)
+	deadline, ok := in.Deadline()
+	if !ok {
+		t.Error("Expected Deadline to report the timeout.")
+	} else if deadline.Before(start) || deadline.After(time.Now().Add(10*time.Millisecond)) {
+		t.Errorf("Unexpected deadline: %v", deadline)
+	}
+
+	if err := in.Wait(); err != worker.ErrTimeout {
+		t.Errorf("Expected ErrTimeout, got: %v", err)
+	}
+	if in.AbortCause() != worker.TimedOut {
+		t.Errorf("Unexpected abort cause: %v", in.AbortCause())
+	}
+}
+
+func TestInstanceAdd(t *testing.T) {
+	release := make(chan bool)
+	wg := new(worker.Group)
+	wg.Add(1, func(abort <-chan bool, data interface{}) error {
+		<-release
+		return nil
+	})
+
+	var lock sync.Mutex
+	added := 0
+	in := wg.Start(nil)
+	err := in.Add(2, func(abort <-chan bool, data interface{}) error {
+		<-release
+		lock.Lock()
+		added++
+		lock.Unlock()
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error from Add: %v", err)
+	}
+	close(release)
+
+	r, err := in.WaitReport()
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if added != 2 || len(r.Workers) != 3 || r.Workers[2].Index != 1 || r.Workers[2].Copy != 1 {
+		t.Errorf("Added Workers were not waited for: %d returned, report %+v", added, r.Workers)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := in.WaitAny(); err != nil {
+			t.Errorf("Unexpected error from WaitAny: %v", err)
+		}
+	}
+	if _, err := in.WaitAny(); err != worker.ErrAllReturned {
+		t.Errorf("Expected ErrAllReturned, got: %v", err)
+	}
+
+	if err := in.Add(1, func(abort <-chan bool, data interface{}) error { return nil }); err != worker.ErrInstanceDone {
+		t.Errorf("Expected ErrInstanceDone, got: %v", err)
+	}
+	if p := wg.Plan(); p.Total != 1 {
+		t.Errorf("Instance.Add changed the Group: %+v", p)
+	}
+}
+
+func TestGroupOf(t *testing.T) {
+	type job struct {
+		lock sync.Mutex
+		sum  int
+	}
+
+	cleaned := false
+	wg := new(worker.GroupOf[*job])
+	wg.Add(4, func(abort <-chan bool, data *job) error {
+		data.lock.Lock()
+		data.sum++
+		data.lock.Unlock()
+		return nil
+	})
+	wg.AddCleaner(func(data *job) { cleaned = data.sum == 4 })
+	wg.Group().SetFailFast(true)
+
+	if err := wg.Run(&job{}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if !cleaned {
+		t.Error("Cleaner did not see the typed data value.")
+	}
+
+	// A nil interface value must not trip up the type assertion.
+	readers := new(worker.GroupOf[io.Reader])
+	readers.Add(1, func(abort <-chan bool, data io.Reader) error {
+		if data != nil {
+			return errTest
+		}
+		return nil
+	})
+	if err := readers.Run(nil); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestAddCleanerE(t *testing.T) {
+	var got []error
+	wg := new(worker.Group)
+	wg.Add(1, func(abort <-chan bool, data interface{}) error {
+		if data.(bool) {
+			return errTest
+		}
+		return nil
+	})
+	wg.AddCleanerE(func(data interface{}, err error) { got = append(got, err) })
+
+	wg.Run(false)
+	wg.Run(true)
+
+	in := wg.Start(false)
+	in.Abort()
+	in.Wait()
+
+	if len(got) != 3 || got[0] != nil || got[1] != errTest || (got[2] != nil && got[2] != worker.NonErrorAbort) {
+		t.Errorf("Unexpected Cleaner errors: %v", got)
+	}
+}
+
+func TestRunning(t *testing.T) {
+	release := make(chan bool)
+	wg := new(worker.Group)
+	wg.Add(1, func(abort <-chan bool, data interface{}) error { return nil })
+	wg.Add(2, func(abort <-chan bool, data interface{}) error {
+		<-release
+		return nil
+	})
+
+	in := wg.Start(nil)
+	in.WaitWorker(0)
+	if in.Running() != 2 || in.Completed() != 1 {
+		t.Errorf("Expected 2 running and 1 completed, got %d and %d.", in.Running(), in.Completed())
+	}
+
+	close(release)
+	in.Wait()
+	if in.Running() != 0 || in.Completed() != 3 {
+		t.Errorf("Expected 0 running and 3 completed, got %d and %d.", in.Running(), in.Completed())
+	}
+}
+
+func TestAbortWith(t *testing.T) {
+	reason := errors.New("Canceled by the user.")
+
+	wg := new(worker.Group)
+	wg.Add(2, func(abort <-chan bool, data interface{}) error {
+		<-abort
+		return nil
+	})
+
+	in := wg.Start(nil)
+	in.AbortWith(reason)
+	in.AbortWith(errTest)
+	if err := in.Wait(); err != reason {
+		t.Errorf("Expected the abort reason, got: %v", err)
+	}
+
+	// A Worker error wins over the reason.
+	wg = new(worker.Group)
+	wg.Add(1, func(abort <-chan bool, data interface{}) error {
+		<-abort
+		return errTest
+	})
+	in = wg.Start(nil)
+	in.AbortWith(reason)
+	if err := in.Wait(); err != errTest {
+		t.Errorf("Expected errTest, got: %v", err)
+	}
+}
+
+func TestAbortWithRace(t *testing.T) {
+	reason := errors.New("Canceled by the user.")
+
+	for i := 0; i < 100; i++ {
+		release := make(chan bool)
+		wg := new(worker.Group)
+		wg.SetRecordTimeline(true)
+		wg.Add(1, func(abort <-chan bool, data interface{}) error {
+			<-release
+			return errTest
+		})
+
+		in := wg.Start(nil)
+		var racers sync.WaitGroup
+		racers.Add(2)
+		go func() {
+			defer racers.Done()
+			<-release
+			in.AbortWith(reason)
+		}()
+		go func() {
+			defer racers.Done()
+			<-release
+			in.Abort()
+		}()
+		close(release)
+
+		// Whoever aborted first, the Worker error still wins.
+		if err := in.Wait(); err != errTest {
+			t.Fatalf("Expected errTest, got: %v", err)
+		}
+		racers.Wait()
+
+		// The recorded cause must be the first one, not a mix of several or a later one.
+		cause, err := in.AbortCause(), in.AbortCausingError()
+		switch {
+		case cause == worker.ExplicitAbort && (err == reason || err == nil):
+		case cause == worker.WorkerError && err == errTest:
+		default:
+			t.Fatalf("Unexpected abort cause %v with error %v", cause, err)
+		}
+
+		var orders []worker.Event
+		for _, e := range in.Timeline() {
+			if e.Kind == worker.AbortOrdered {
+				orders = append(orders, e)
+			}
+		}
+		if err == nil {
+			err = worker.NonErrorAbort
+		}
+		if len(orders) != 1 || orders[0].Cause != cause || orders[0].Err != err {
+			t.Fatalf("Expected one abort matching %v (%v), got: %+v", cause, err, orders)
+		}
+	}
+}
+
+func TestWaitContext(t *testing.T) {
+	wg := new(worker.Group)
+	wg.Add(1, func(abort <-chan bool, data interface{}) error {
+		<-abort
+		return errTest
+	})
+
+	in := wg.Start(nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := in.WaitContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected DeadlineExceeded, got: %v", err)
+	}
+	if in.Done() {
+		t.Error("Instance finished after WaitContext gave up.")
+	}
+
+	in.Abort()
+	if err := in.WaitContext(context.Background()); err != errTest {
+		t.Errorf("Expected errTest, got: %v", err)
+	}
+}
+
+func TestAddRetry(t *testing.T) {
+	var lock sync.Mutex
+	runs := 0
+	wg := new(worker.Group)
+	wg.AddRetry(1, 3, func(abort <-chan bool, data interface{}) error {
+		lock.Lock()
+		defer lock.Unlock()
+		runs++
+		if runs < 3 {
+			return errTest
+		}
+		return nil
+	})
+	if err := wg.Run(nil); err != nil || runs != 3 {
+		t.Errorf("Expected success after 3 runs, got %v after %d.", err, runs)
+	}
+
+	runs = 0
+	wg = new(worker.Group)
+	wg.AddRetry(1, 2, func(abort <-chan bool, data interface{}) error {
+		lock.Lock()
+		defer lock.Unlock()
+		runs++
+		return fmt.Errorf("Attempt %d.", runs)
+	})
+	if err := wg.Run(nil); err == nil || err.Error() != "Attempt 3." {
+		t.Errorf("Expected the last attempt's error, got: %v", err)
+	}
+
+	// No retries once the Instance is aborting.
+	runs = 0
+	wg = new(worker.Group)
+	wg.AddRetry(1, 5, func(abort <-chan bool, data interface{}) error {
+		<-abort
+		lock.Lock()
+		defer lock.Unlock()
+		runs++
+		return errTest
+	})
+	in := wg.Start(nil)
+	in.Abort()
+	in.Wait()
+	if runs != 1 {
+		t.Errorf("Expected 1 run after abort, got %d.", runs)
+	}
+}
+
+func TestTotalRetryBudget(t *testing.T) {
+	var lock sync.Mutex
+	runs := 0
+	wg := new(worker.Group)
+	wg.AddRetry(3, 5, func(abort <-chan bool, data interface{}) error {
+		lock.Lock()
+		defer lock.Unlock()
+		runs++
+		return errTest
+	})
+	wg.SetTotalRetryBudget(4)
+	// Tolerate the errors themselves, running out of retries must abort anyway.
+	wg.AbortIf(func(err error) bool { return false })
+
+	in := wg.Start(nil)
+	report, err := in.WaitReport()
+	if !errors.Is(err, worker.ErrRetryBudget) {
+		t.Errorf("Expected ErrRetryBudget, got: %v", err)
+	}
+	if c := in.AbortCause(); c != worker.RetryBudgetExhausted {
+		t.Errorf("Expected RetryBudgetExhausted, got: %v", c)
+	}
+	if report.Retries != 4 || runs > 3+4 {
+		t.Errorf("Expected 4 retries and at most 7 runs, got %d retries and %d runs.", report.Retries, runs)
+	}
+
+	var budget *worker.RetryBudgetError
+	for _, werr := range in.Errors() {
+		if errors.As(werr, &budget) {
+			break
+		}
+	}
+	if budget == nil || budget.Budget != 4 || !errors.Is(budget, errTest) {
+		t.Errorf("Expected a *RetryBudgetError wrapping errTest, got: %v", in.Errors())
+	}
+}
+
+func TestSetMaxConcurrent(t *testing.T) {
+	var lock sync.Mutex
+	running, peak, runs := 0, 0, 0
+
+	wg := new(worker.Group)
+	wg.SetMaxConcurrent(3)
+	wg.Add(20, func(abort <-chan bool, data interface{}) error {
+		lock.Lock()
+		running++
+		runs++
+		if running > peak {
+			peak = running
+		}
+		lock.Unlock()
+
+		time.Sleep(time.Millisecond)
+
+		lock.Lock()
+		running--
+		lock.Unlock()
+		return nil
+	})
+	if err := wg.Run(nil); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if peak > 3 || runs != 20 {
+		t.Errorf("Expected 20 runs with at most 3 at once, got %d with %d.", runs, peak)
+	}
+
+	// Queued Workers are skipped once the Instance aborts.
+	runs = 0
+	entered := make(chan bool, 5)
+	wg = new(worker.Group)
+	wg.SetMaxConcurrent(1)
+	wg.Add(5, func(abort <-chan bool, data interface{}) error {
+		lock.Lock()
+		runs++
+		lock.Unlock()
+		entered <- true
+		<-abort
+		return nil
+	})
+	in := wg.Start(nil)
+	<-entered
+	in.Abort()
+	in.Wait()
+	if runs != 1 {
+		t.Errorf("Expected 1 run, got %d.", runs)
+	}
+}
+
+func TestCheckAbort(t *testing.T) {
+	open := make(chan bool)
+	if worker.Aborted(open) || worker.CheckAbort(open) != nil {
+		t.Error("Open channel reported as aborted.")
+	}
+
+	closed := make(chan bool)
+	close(closed)
+	if !worker.Aborted(closed) || worker.CheckAbort(closed) != worker.ErrAborted {
+		t.Error("Closed channel not reported as aborted.")
+	}
+
+	// Returning ErrAborted during an abort is not an error.
+	wg := new(worker.Group)
+	wg.SetAbortIsError(false)
+	wg.Add(2, func(abort <-chan bool, data interface{}) error {
+		<-abort
+		return fmt.Errorf("Nested: %w", worker.CheckAbort(abort))
+	})
+	in := wg.Start(nil)
+	in.Abort()
+	if err := in.Wait(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestAddIndexed(t *testing.T) {
+	slots := make([]int, 4)
+	wg := new(worker.Group)
+	wg.AddIndexed(len(slots), func(abort <-chan bool, data interface{}, copy int) error {
+		data.([]int)[copy] = copy + 1
+		return nil
+	})
+	if err := wg.Run(slots); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	for i, v := range slots {
+		if v != i+1 {
+			t.Errorf("Slot %d: expected %d, got %d.", i, i+1, v)
+		}
+	}
+}
+
+func TestCleanerPanic(t *testing.T) {
+	ran := false
+	wg := new(worker.Group)
+	wg.Add(1, func(abort <-chan bool, data interface{}) error { return nil })
+	wg.AddCleaner(func(data interface{}) { panic(errTest) })
+	wg.AddCleaner(func(data interface{}) { ran = true })
+
+	in := wg.Start(nil)
+	if err := in.Wait(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if !ran {
+		t.Error("Cleaner after the panicking one did not run.")
+	}
+
+	var perr *worker.CleanerPanicError
+	errs := in.CleanupErrors()
+	if len(errs) != 1 || !errors.As(errs[0], &perr) || perr.Index != 0 || !errors.Is(errs[0], errTest) {
+		t.Errorf("Unexpected cleanup errors: %v", errs)
+	}
+}
+
+func TestOnWorkerFinish(t *testing.T) {
+	var lock sync.Mutex
+	started := map[int]bool{}
+	finished := map[int]error{}
+
+	wg := new(worker.Group)
+	wg.Add(3, func(abort <-chan bool, data interface{}) error { return nil })
+	wg.Add(1, func(abort <-chan bool, data interface{}) error { return errTest })
+	wg.OnWorkerStart(func(id int) {
+		lock.Lock()
+		started[id] = true
+		lock.Unlock()
+	})
+	wg.OnWorkerFinish(func(id int, elapsed time.Duration, err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if !started[id] {
+			t.Errorf("Worker %d finished without starting.", id)
+		}
+		finished[id] = err
+	})
+
+	wg.Run(nil)
+	if len(finished) != 4 || finished[0] != nil || finished[3] != errTest {
+		t.Errorf("Unexpected finish calls: %v", finished)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	jobs := make(chan int)
+	var lock sync.Mutex
+	done := 0
+
+	wg := new(worker.Group)
+	wg.AddSignal(2, func(abort *worker.Abort, data interface{}) error {
+		for {
+			select {
+			case <-abort.DrainChan():
+				if abort.Level() != worker.SoftAbort {
+					return errTest
+				}
+				return nil
+			case <-jobs:
+				lock.Lock()
+				done++
+				lock.Unlock()
+			}
+		}
+	})
+
+	in := wg.Start(nil)
+	jobs <- 1
+	jobs <- 2
+	in.Drain()
+	in.Drain()
+	if err := in.Wait(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if done != 2 || in.AbortCause() != worker.NotAborted {
+		t.Errorf("Expected 2 jobs and no abort, got %d and %v.", done, in.AbortCause())
+	}
+
+	// Aborting closes the drain channel too.
+	in = wg.Start(nil)
+	in.Abort()
+	if err := in.Wait(); err != errTest {
+		t.Errorf("Expected errTest, got: %v", err)
+	}
+	select {
+	case <-in.Draining():
+	default:
+		t.Error("Drain channel still open after abort.")
+	}
+}
+
+func TestWaitOrLeak(t *testing.T) {
+	stuck := make(chan bool)
+	defer close(stuck)
+
+	wg := new(worker.Group)
+	wg.Add(1, func(abort <-chan bool, data interface{}) error {
+		<-abort
+		return errTest
+	})
+	wg.Add(2, func(abort <-chan bool, data interface{}) error {
+		<-stuck
+		return nil
+	})
+	wg.SetStragglerGrace(10 * time.Millisecond)
+
+	in := wg.Start(nil)
+	in.Abort()
+
+	var leak *worker.LeakError
+	err := in.WaitOrLeak()
+	if !errors.As(err, &leak) || !errors.Is(err, worker.ErrWorkersLeaked) || !errors.Is(err, errTest) {
+		t.Fatalf("Expected a LeakError, got: %v", err)
+	}
+	if len(leak.IDs) != 2 || leak.IDs[0] != 1 || leak.IDs[1] != 2 {
+		t.Errorf("Unexpected leaked IDs: %v", leak.IDs)
+	}
+
+	// Nothing leaked, nothing reported.
+	wg = new(worker.Group)
+	wg.Add(2, func(abort <-chan bool, data interface{}) error { return nil })
+	wg.SetStragglerGrace(10 * time.Millisecond)
+	if err := wg.Start(nil).WaitOrLeak(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestRunAll(t *testing.T) {
+	if err := worker.RunAll(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	blocker := new(worker.Group)
+	blocker.Add(1, func(abort <-chan bool, data interface{}) error {
+		<-abort
+		return nil
+	})
+	failer := new(worker.Group)
+	failer.Add(1, func(abort <-chan bool, data interface{}) error { return errTest })
+
+	a, b := blocker.Start(nil), blocker.Start(nil)
+	if err := worker.RunAll(a, nil, failer.Start(nil), b); err != errTest {
+		t.Errorf("Expected errTest, got: %v", err)
+	}
+	if !worker.IsAbort(a.Wait()) || !worker.IsAbort(b.Wait()) {
+		t.Error("Siblings were not aborted.")
+	}
+}
+
+func TestAbortAll(t *testing.T) {
+	wg := new(worker.Group)
+	wg.Add(2, func(abort <-chan bool, data interface{}) error {
+		<-abort
+		return nil
+	})
+
+	instances := []*worker.Instance{wg.Start(nil), nil, wg.Start(nil), wg.Start(nil)}
+	worker.AbortAll(instances...)
+	for i, err := range worker.WaitAll(instances...) {
+		if instances[i] != nil && err != worker.NonErrorAbort {
+			t.Errorf("Expected NonErrorAbort from Instance %d, got: %v", i, err)
+		}
+	}
+}
+
+func TestMergeResults(t *testing.T) {
+	wg := new(worker.Group)
+	wg.AddCollector(1, func(abort <-chan bool, data interface{}) (interface{}, error) {
+		return data.(int) * 10, nil
+	})
+
+	merged := worker.MergeResults[int](wg.Start(1), nil, new(worker.Group).Start(nil), wg.Start(2))
+	if len(merged) != 2 || merged[0] != 10 || merged[1] != 20 {
+		t.Errorf("Unexpected merged results: %v", merged)
+	}
+	if merged := worker.MergeResults[int](); len(merged) != 0 {
+		t.Errorf("Expected no results, got: %v", merged)
+	}
+}
+
+func TestPanicIsolation(t *testing.T) {
+	release := make(chan bool)
+	wg := new(worker.Group)
+	wg.SetRecoverPanics(true)
+	wg.Add(2, func(abort <-chan bool, data interface{}) error {
+		if data.(bool) {
+			panic(errTest)
+		}
+		select {
+		case <-release:
+		case <-abort:
+			return errTest
+		}
+		return nil
+	})
+
+	// A healthy Instance of the same Group running alongside must not be affected.
+	healthy := wg.Start(false)
+	if err := wg.Run(true); !errors.Is(err, errTest) {
+		t.Errorf("Expected the panic, got: %v", err)
+	}
+	close(release)
+	if err := healthy.Wait(); err != nil {
+		t.Errorf("A panic in one Instance affected another: %v", err)
+	}
+
+	// The Group itself is unchanged, and can still be run.
+	if err := wg.Run(false); err != nil {
+		t.Errorf("Group unusable after a panic: %v", err)
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	// Whichever Worker gets the only slot first holds it until the rest have queued up, then the scheduler runs them
+	// highest ID first.
+	release := make(chan bool)
+	var first sync.Once
+	var order, picked []int
+	wg := new(worker.Group)
+	wg.SetMaxConcurrent(1)
+	wg.AddIndexed(5, func(abort <-chan bool, data interface{}, copy int) error {
+		held := false
+		first.Do(func() {
+			<-release
+			held = true
+		})
+		if !held {
+			order = append(order, copy)
+		}
+		return nil
+	})
+	wg.SetScheduler(func(waiting []int) int {
+		max := waiting[0]
+		for _, id := range waiting {
+			if id > max {
+				max = id
+			}
+		}
+		picked = append(picked, max)
+		return max
+	})
+
+	in := wg.Start(nil)
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	if err := in.Wait(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(order) != 4 || fmt.Sprint(order) != fmt.Sprint(picked) {
+		t.Errorf("Workers did not run in the order the scheduler picked: ran %v, picked %v", order, picked)
+	}
+	for i := 1; i < len(order); i++ {
+		if order[i] > order[i-1] {
+			t.Errorf("Expected the highest ID first, got: %v", order)
+			break
+		}
+	}
+}
+
+func TestMaxConcurrentWaiting(t *testing.T) {
+	var order []string
+	wg := new(worker.Group)
+	wg.SetMaxConcurrent(1)
+	wg.AddNode("b", []string{"a"}, func(abort <-chan bool, data interface{}) error {
+		order = append(order, "b")
+		return nil
+	})
+	wg.AddNode("a", nil, func(abort <-chan bool, data interface{}) error {
+		order = append(order, "a")
+		return nil
+	})
+
+	done := make(chan error)
+	go func() { done <- wg.Run(nil) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Deadlocked waiting on a dependency.")
+	}
+	if len(order) != 2 || order[0] != "a" {
+		t.Errorf("Unexpected node order: %v", order)
+	}
+
+	// A staggered copy waiting out its delay must not keep the slot.
+	ran := make(chan bool)
+	wg = new(worker.Group)
+	wg.SetMaxConcurrent(1)
+	wg.AddStaggered(2, time.Hour, func(abort <-chan bool, data interface{}) error { return nil })
+	wg.Add(1, func(abort <-chan bool, data interface{}) error {
+		close(ran)
+		return nil
+	})
+	in := wg.Start(nil)
+	select {
+	case <-ran:
+	case <-time.After(5 * time.Second):
+		t.Error("Worker blocked by a staggered copy's delay.")
+	}
+	in.Abort()
+	in.Wait()
+}
+
+// sliceError is an error type that can't be compared with ==.
+type sliceError []string
+
+func (err sliceError) Error() string { return strings.Join(err, ", ") }
+
+func TestJoinErrorsUncomparable(t *testing.T) {
+	wg := new(worker.Group)
+	wg.SetJoinErrors(true)
+	wg.SetErrorThreshold(2)
+	wg.Add(2, func(abort <-chan bool, data interface{}) error {
+		return sliceError{"a", "b"}
+	})
+
+	err := wg.Run(nil)
+	var se sliceError
+	if !errors.As(err, &se) || !strings.Contains(err.Error(), "\n") {
+		t.Errorf("Expected the joined errors, got: %v", err)
+	}
+}
+
+func TestBufferPool(t *testing.T) {
+	var lock sync.Mutex
+	created := 0
+
+	wg := new(worker.Group)
+	wg.SetBufferPool(func() interface{} {
+		lock.Lock()
+		created++
+		lock.Unlock()
+		return new([64]byte)
+	})
+	wg.AddWithInstance(4, func(abort <-chan bool, data interface{}, in *worker.Instance) error {
+		for i := 0; i < 100; i++ {
+			b, ok := in.GetBuffer().(*[64]byte)
+			if !ok {
+				return errTest
+			}
+			b[0] = byte(i)
+			in.PutBuffer(b)
+		}
+		return nil
+	})
+	if err := wg.Run(nil); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if created == 0 {
+		t.Error("The pool's New function was never called.")
+	}
+
+	// Without a pool there are no buffers.
+	wg = new(worker.Group)
+	wg.AddWithInstance(1, func(abort <-chan bool, data interface{}, in *worker.Instance) error {
+		if in.GetBuffer() != nil {
+			return errTest
+		}
+		return nil
+	})
+	if err := wg.Run(nil); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	drains := func(abort *worker.Abort, data interface{}) error {
+		<-abort.DrainChan()
+		return nil
+	}
+
+	wg := new(worker.Group)
+	wg.AddSignal(2, drains)
+	in := wg.Start(nil)
+	if err := in.DrainTimeout(time.Hour); err != nil {
+		t.Errorf("Expected a clean drain, got: %v", err)
+	}
+
+	// The second Worker ignores the drain, so it has to be aborted.
+	wg = new(worker.Group)
+	wg.AddSignal(1, drains)
+	wg.Add(1, func(abort <-chan bool, data interface{}) error {
+		<-abort
+		return nil
+	})
+	in = wg.Start(nil)
+	err := in.DrainTimeout(10 * time.Millisecond)
+	var dterr *worker.DrainTimeoutError
+	if !errors.As(err, &dterr) || !errors.Is(err, worker.ErrDrainTimeout) || !worker.IsAbort(err) {
+		t.Fatalf("Expected a *DrainTimeoutError wrapping NonErrorAbort, got: %v", err)
+	}
+	if len(dterr.IDs) != 1 || dterr.IDs[0] != 1 {
+		t.Errorf("Expected only Worker 1 to need escalation, got: %v", dterr.IDs)
+	}
+	if in.AbortCause() != worker.ExplicitAbort {
+		t.Errorf("Unexpected abort cause: %v", in.AbortCause())
+	}
+
+	// Nothing to escalate if the Instance is already aborting.
+	wg = new(worker.Group)
+	wg.Add(1, func(abort <-chan bool, data interface{}) error {
+		<-abort
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	})
+	in = wg.Start(nil)
+	in.AbortWith(errTest)
+	if err := in.DrainTimeout(time.Millisecond); err != errTest {
+		t.Errorf("Expected errTest, got: %v", err)
+	}
+}
+
+func TestReplace(t *testing.T) {
+	handled := make(chan string, 10)
+	consume := func(name string) worker.SignalWorker {
+		return func(abort *worker.Abort, data interface{}) error {
+			jobs := data.(chan int)
+			for {
+				select {
+				case <-abort.DrainChan():
+					return nil
+				case _, ok := <-jobs:
+					if !ok {
+						return nil
+					}
+					handled <- name
+				}
+			}
+		}
+	}
+
+	old := new(worker.Group)
+	old.AddSignal(1, consume("old"))
+	jobs := make(chan int)
+	in := old.Start(jobs)
+	jobs <- 1
+	if name := <-handled; name != "old" {
+		t.Errorf("Expected the old Worker to handle the first job, got %q", name)
+	}
+
+	// The new data value is how the work source is handed over, here it is just the same channel again.
+	replacement := new(worker.Group)
+	replacement.AddSignal(2, consume("new"))
+	if err := in.Replace(replacement, jobs); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := in.WaitWorker(0); err != nil {
+		t.Errorf("Unexpected error from the old Worker: %v", err)
+	}
+
+	// Only the new Workers are left, and they didn't see the old drain.
+	jobs <- 2
+	jobs <- 3
+	close(jobs)
+	if err := in.Wait(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if a, b := <-handled, <-handled; a != "new" || b != "new" {
+		t.Errorf("Expected the new Workers to handle the rest, got %q and %q", a, b)
+	}
+	if n := len(in.Report().Workers); n != 3 {
+		t.Errorf("Expected 3 Workers in the report, got %d", n)
+	}
+
+	if err := in.Replace(replacement, nil); err != worker.ErrInstanceDone {
+		t.Errorf("Expected ErrInstanceDone, got: %v", err)
+	}
+	in = old.Start(make(chan int))
+	defer in.Close()
+	if err := in.Replace(new(worker.Group), nil); !errors.Is(err, worker.ErrNoWorkers) {
+		t.Errorf("Expected the empty Group to fail validation, got: %v", err)
+	}
+	nodes := new(worker.Group)
+	nodes.AddNode("a", nil, func(abort <-chan bool, data interface{}) error { return nil })
+	if err := in.Replace(nodes, nil); err != worker.ErrReplaceNodes {
+		t.Errorf("Expected ErrReplaceNodes, got: %v", err)
+	}
+}
+
+func TestCleanOnlyIfStarted(t *testing.T) {
+	cleaned := 0
+	var launch []func()
+	wg := new(worker.Group)
+	wg.SetCleanOnlyIfStarted(true)
+	wg.SetMaxConcurrent(1)
+	wg.SetSpawner(func(fn func()) { launch = append(launch, fn) })
+	wg.Add(2, func(abort <-chan bool, data interface{}) error { return nil })
+	wg.AddCleaner(func(data interface{}) { cleaned++ })
+
+	// Abort before the Workers' goroutines even exist, so they are all skipped.
+	in := wg.Start(nil)
+	in.Abort()
+	for _, fn := range launch {
+		go fn()
+	}
+	in.Wait()
+	if cleaned != 0 {
+		t.Error("Cleaner ran although no Worker started.")
+	}
+
+	// SetAlwaysClean wins.
+	launch = nil
+	wg.SetAlwaysClean(true)
+	in = wg.Start(nil)
+	in.Abort()
+	for _, fn := range launch {
+		go fn()
+	}
+	in.Wait()
+	if cleaned != 1 {
+		t.Error("Cleaner did not run with SetAlwaysClean(true).")
+	}
+
+	wg = new(worker.Group)
+	wg.SetCleanOnlyIfStarted(true)
+	wg.Add(1, func(abort <-chan bool, data interface{}) error { return nil })
+	wg.AddCleaner(func(data interface{}) { cleaned++ })
+	if err := wg.Run(nil); err != nil || cleaned != 2 {
+		t.Errorf("Cleaner did not run after a Worker started (error: %v)", err)
+	}
+}
+
+func TestCleanOnlyIfStartedWaiting(t *testing.T) {
+	// run starts wg under a TestController, steps the Worker with the given ID until it is inside the runner, aborts,
+	// then runs the rest (which are skipped, as they see the abort before getting a slot).
+	run := func(wg *worker.Group, id int) {
+		ctl := new(worker.TestController)
+		entered := make(chan bool, 1)
+		wg.SetTestMode(ctl)
+		wg.SetCleanOnlyIfStarted(true)
+		wg.OnWorkerStart(func(started int) {
+			if started == id {
+				entered <- true
+			}
+		})
+
+		in := wg.Start(nil)
+		stepped := make(chan bool)
+		go func() {
+			ctl.Step(id)
+			close(stepped)
+		}()
+		<-entered
+		in.Abort()
+		<-stepped
+		ctl.RunAll()
+		in.Wait()
+	}
+
+	// A node waiting on a dependency that never runs.
+	cleaned := false
+	body := false
+	wg := new(worker.Group)
+	wg.SetMaxConcurrent(1)
+	wg.AddNode("a", nil, func(abort <-chan bool, data interface{}) error {
+		body = true
+		return nil
+	})
+	wg.AddNode("b", []string{"a"}, func(abort <-chan bool, data interface{}) error {
+		body = true
+		return nil
+	})
+	wg.AddCleaner(func(data interface{}) { cleaned = true })
+	run(wg, 1)
+	if body || cleaned {
+		t.Errorf("Expected no Worker and no Cleaner to run, got Worker: %v, Cleaner: %v", body, cleaned)
+	}
+
+	// A staggered copy that is aborted during its delay, while the first copy never gets a slot.
+	cleaned, body = false, false
+	wg = new(worker.Group)
+	wg.SetMaxConcurrent(2)
+	wg.AddStaggered(2, time.Hour, func(abort <-chan bool, data interface{}) error {
+		body = true
+		return nil
+	})
+	wg.AddCleaner(func(data interface{}) { cleaned = true })
+	run(wg, 1)
+	if body || cleaned {
+		t.Errorf("Expected no Worker and no Cleaner to run, got Worker: %v, Cleaner: %v", body, cleaned)
+	}
+}
+
+func TestPprofLabels(t *testing.T) {
+	release := make(chan bool)
+	wg := new(worker.Group)
+	wg.SetPprofLabels(true)
+	wg.Add(1, func(abort <-chan bool, data interface{}) error { return nil })
+	wg.Add(1, func(abort <-chan bool, data interface{}) error {
+		<-release
+		return nil
+	})
+
+	// The blocked Worker (ID 1, from the second registration) shows up in the goroutine profile with its labels.
+	in := wg.Start(nil)
+	in.WaitStarted()
+	var profile strings.Builder
+	if err := pprof.Lookup("goroutine").WriteTo(&profile, 1); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	in.Wait()
+
+	if !strings.Contains(profile.String(), `"workergroup.id":"1", "workergroup.worker":"1"`) {
+		t.Errorf("Worker labels not found in the goroutine profile:\n%s", profile.String())
+	}
+}
+
+func TestAddLocked(t *testing.T) {
+	var lock sync.Mutex
+	seen := map[int]bool{}
+	wg := new(worker.Group)
+	wg.AddLocked(3, func(abort <-chan bool, data interface{}) error {
+		lock.Lock()
+		seen[data.(int)] = true
+		lock.Unlock()
+		return nil
+	})
+	if err := wg.Run(7); err != nil || len(seen) != 1 || !seen[7] {
+		t.Errorf("Unexpected result: %v, %v", err, seen)
+	}
+
+	wg = new(worker.Group)
+	wg.AddLocked(1, func(abort <-chan bool, data interface{}) error { return errTest })
+	if err := wg.Run(nil); err != errTest {
+		t.Errorf("Expected errTest, got: %v", err)
+	}
+
+	// The thread is unlocked even if the Worker panics.
+	wg = new(worker.Group)
+	wg.SetRecoverPanics(true)
+	wg.AddLocked(1, func(abort <-chan bool, data interface{}) error { panic("boom") })
+	var perr *worker.PanicError
+	if err := wg.Run(nil); !errors.As(err, &perr) {
+		t.Errorf("Expected a *PanicError, got: %v", err)
+	}
+
+	wg = new(worker.Group)
+	wg.AddLocked(1, nil)
+	if err := wg.Validate(); err == nil {
+		t.Error("Expected Validate to report a nil Worker.")
+	}
+}
+
+func TestStartChecked(t *testing.T) {
+	ran := false
+	wg := new(worker.Group)
+	wg.Add(1, func(abort <-chan bool, data interface{}) error {
+		ran = true
+		return nil
+	})
+	wg.Add(1, nil)
+	wg.AddCleaner(nil)
+
+	in, err := wg.StartChecked(nil)
+	var verr *worker.ValidationError
+	if in != nil || !errors.As(err, &verr) {
+		t.Fatalf("Expected a *ValidationError and no Instance, got %v, %v", in, err)
+	}
+	if len(verr.Problems) != 2 {
+		t.Errorf("Expected both problems to be reported, got: %v", verr.Problems)
+	}
+	if ran {
+		t.Error("A Worker was launched although the Group failed validation.")
+	}
+
+	if _, err := new(worker.Group).StartChecked(nil); !errors.Is(err, worker.ErrNoWorkers) {
+		t.Errorf("Expected ErrNoWorkers, got: %v", err)
+	}
+
+	wg = new(worker.Group)
+	wg.Add(1, func(abort <-chan bool, data interface{}) error { return errTest })
+	in, err = wg.StartChecked(nil)
+	if err != nil || in == nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := in.Wait(); err != errTest {
+		t.Errorf("Expected errTest, got: %v", err)
+	}
+}
+
+func TestPackageRun(t *testing.T) {
+	var lock sync.Mutex
+	copies := 0
+	count := func(abort <-chan bool, data interface{}) error {
+		lock.Lock()
+		copies += data.(int)
+		lock.Unlock()
+		return nil
+	}
+
+	if err := worker.Run(3, 1, count); err != nil || copies != 3 {
+		t.Errorf("Expected 3 copies, got %d (error: %v)", copies, err)
+	}
+	copies = 0
+	if err := worker.Run(0, 1, count); err != nil || copies != runtime.NumCPU() {
+		t.Errorf("Expected runtime.NumCPU copies, got %d (error: %v)", copies, err)
+	}
+
+	// An error aborts the other copies, as with a Group.
+	copies = 0
+	err := worker.Run(2, nil, func(abort <-chan bool, data interface{}) error {
+		lock.Lock()
+		first := copies == 0
+		copies++
+		lock.Unlock()
+		if first {
+			return errTest
+		}
+		<-abort
+		return nil
+	})
+	if err != errTest {
+		t.Errorf("Expected errTest, got: %v", err)
+	}
+}
+
+func TestStartNoClean(t *testing.T) {
+	cleaned := 0
+	wg := new(worker.Group)
+	wg.Add(1, func(abort <-chan bool, data interface{}) error { return errTest })
+	wg.AddCleaner(func(data interface{}) { cleaned++ })
+	wg.AddFailureCleaner(func(data interface{}) { cleaned++ })
+
+	in := wg.StartNoClean(nil)
+	if err := in.Wait(); err != errTest {
+		t.Errorf("Expected errTest, got: %v", err)
+	}
+	if cleaned != 0 {
+		t.Errorf("Expected no Cleaners to run, %d did", cleaned)
+	}
+
+	// The Group itself is unchanged.
+	if err := wg.Run(nil); err != errTest || cleaned != 2 {
+		t.Errorf("Expected both Cleaners to run for a normal Start, %d did (error: %v)", cleaned, err)
+	}
+}
+
+func TestConcurrentCleaners(t *testing.T) {
+	// Each Cleaner waits until all of them have started, which can only happen if they overlap.
+	var started sync.WaitGroup
+	started.Add(3)
+	overlapped := make(chan bool, 3)
+	clean := func(data interface{}) {
+		started.Done()
+		done := make(chan bool)
+		go func() {
+			started.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+			overlapped <- true
+		case <-time.After(time.Second):
+			overlapped <- false
+		}
+	}
+
+	wg := new(worker.Group)
+	wg.SetConcurrentCleaners(true)
+	wg.Add(1, func(abort <-chan bool, data interface{}) error { return nil })
+	for i := 0; i < 3; i++ {
+		wg.AddCleaner(clean)
+	}
+	if err := wg.Run(nil); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Run returns only once every Cleaner has.
+	if len(overlapped) != 3 {
+		t.Fatalf("Run returned before the Cleaners did, %d of 3 finished", len(overlapped))
+	}
+	for i := 0; i < 3; i++ {
+		if !<-overlapped {
+			t.Error("Cleaners did not run at the same time.")
+		}
+	}
+}
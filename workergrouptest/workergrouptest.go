@@ -0,0 +1,124 @@
+/*
+Copyright 2016 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+// Test helpers for code that uses workergroup.
+//
+// These live in their own package so that importing workergroup doesn't pull the testing package into programs.
+package workergrouptest
+
+import "errors"
+import "runtime"
+import "testing"
+import "time"
+
+import "github.com/milochristiansen/workergroup"
+
+// leakSettle is how long AssertNoLeaks waits for goroutines to exit before giving up.
+const leakSettle = time.Second
+
+// AssertNoLeaks runs fn, then fails the test if there are more goroutines running afterwards than there were before.
+// Use this around code that starts and waits on Instances to make sure none of your Workers ignore their abort channel
+// and leak.
+//
+// Goroutines don't exit instantly, so AssertNoLeaks gives them up to a second to settle before failing. Since this
+// works by counting every goroutine in the process, it will give false results if other goroutines are being started
+// or stopped at the same time (for example by parallel tests).
+func AssertNoLeaks(t testing.TB, fn func()) {
+	t.Helper()
+
+	before := runtime.NumGoroutine()
+	fn()
+
+	deadline := time.Now().Add(leakSettle)
+	after := runtime.NumGoroutine()
+	for after > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		after = runtime.NumGoroutine()
+	}
+
+	if after > before {
+		buf := make([]byte, 1<<16)
+		buf = buf[:runtime.Stack(buf, true)]
+		t.Errorf("%d goroutine(s) leaked, %d running before and %d after.\n%s", after-before, before, after, buf)
+	}
+}
+
+// AssertCompleted blocks until the Instance is done, then fails the test unless the Workers that ran match expected
+// exactly. expected maps Worker IDs (indexes in RunReport.Workers) to the error each should have returned, use nil for
+// Workers that should succeed. Errors are compared with errors.Is, so wrapped errors match.
+func AssertCompleted(t testing.TB, in *workergroup.Instance, expected map[int]error) {
+	t.Helper()
+
+	report := in.Report()
+	if len(report.Workers) != len(expected) {
+		t.Errorf("expected %d Workers to complete, got %d", len(expected), len(report.Workers))
+	}
+
+	for id, w := range report.Workers {
+		want, ok := expected[id]
+		if !ok {
+			t.Errorf("Worker %d (registration %d) completed unexpectedly, returning %v", id, w.Index, w.Err)
+			continue
+		}
+		if !errors.Is(w.Err, want) {
+			t.Errorf("Worker %d (registration %d) returned %v, expected %v", id, w.Index, w.Err, want)
+		}
+	}
+	for id := range expected {
+		if id < 0 || id >= len(report.Workers) {
+			t.Errorf("Worker %d was expected but never ran", id)
+		}
+	}
+}
+
+// MeasureAllocs returns the number of heap allocations made while running fn. Use it to guard against regressions
+// that add allocations to a hot Worker loop, for example:
+//
+//	func BenchmarkRun(b *testing.B) {
+//		allocs := workergrouptest.MeasureAllocs(func() {
+//			for i := 0; i < b.N; i++ {
+//				wg.Run(nil)
+//			}
+//		})
+//		if allocs/uint64(b.N) > budget {
+//			b.Errorf("too many allocations per run: %d", allocs/uint64(b.N))
+//		}
+//	}
+//
+// The cost of reading the memory statistics is measured and subtracted, so it is not included. Allocations made by
+// any other goroutine while fn runs are counted though, so don't run this in parallel with other work.
+func MeasureAllocs(fn func()) uint64 {
+	var start, calibrate, end runtime.MemStats
+
+	runtime.ReadMemStats(&start)
+	runtime.ReadMemStats(&calibrate)
+	overhead := calibrate.Mallocs - start.Mallocs
+
+	fn()
+	runtime.ReadMemStats(&end)
+
+	allocs := end.Mallocs - calibrate.Mallocs
+	if allocs < overhead {
+		return 0
+	}
+	return allocs - overhead
+}
@@ -0,0 +1,75 @@
+/*
+Copyright 2016 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package workergrouptest_test
+
+import (
+	"errors"
+	"testing"
+
+	worker "github.com/milochristiansen/workergroup"
+	"github.com/milochristiansen/workergroup/workergrouptest"
+)
+
+var errTest = errors.New("test error")
+
+func TestAssertNoLeaks(t *testing.T) {
+	workergrouptest.AssertNoLeaks(t, func() {
+		wg := new(worker.Group)
+		wg.Add(4, func(abort <-chan bool, data interface{}) error {
+			<-abort
+			return nil
+		})
+		wg.Start(nil).Close()
+	})
+}
+
+func TestAssertCompleted(t *testing.T) {
+	wg := new(worker.Group)
+	wg.Add(1, func(abort <-chan bool, data interface{}) error {
+		return errTest
+	})
+	wg.Add(1, func(abort <-chan bool, data interface{}) error {
+		return nil
+	})
+
+	workergrouptest.AssertCompleted(t, wg.Start(nil), map[int]error{0: errTest, 1: nil})
+}
+
+// allocSink keeps TestMeasureAllocs' allocations on the heap.
+var allocSink [][]byte
+
+func TestMeasureAllocs(t *testing.T) {
+	if n := workergrouptest.MeasureAllocs(func() {}); n > 2 {
+		t.Errorf("Expected (almost) no allocations for an empty function, got %d", n)
+	}
+
+	n := workergrouptest.MeasureAllocs(func() {
+		for i := 0; i < 100; i++ {
+			allocSink = append(allocSink[:0], make([]byte, 64))
+		}
+	})
+	allocSink = nil
+	if n < 100 || n > 110 {
+		t.Errorf("Expected about 100 allocations, got %d", n)
+	}
+}